@@ -7,8 +7,12 @@ import (
 	"flag"
 	"net/http"
 	"os"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 
@@ -23,8 +27,48 @@ const (
 
 type proxyConf struct {
 	listenAddress      string
+	tlsCertFile        string
+	tlsKeyFile         string
+	clientCAFile       string
 	metricServer       string
 	kubeconfigLocation string
+	strictQueryRewrite bool
+	responseFiltering  bool
+
+	negativeClusterMatcher bool
+	routes                 map[string]string
+
+	namespaceAccessFile         string
+	allowSeriesWithoutNamespace bool
+
+	authenticator        string
+	trustForwardedGroups bool
+	oidcIssuer           string
+	oidcAudience         string
+	oidcJWKSFile         string
+	oidcJWKSURL          string
+	oidcUsernameClaim    string
+	oidcUsernamePrefix   string
+	oidcGroupsClaim      string
+	oidcGroupsPrefix     string
+
+	clusterAuthorization      string
+	accessReviewVerb          string
+	accessReviewSubresource   string
+	accessReviewCacheDuration time.Duration
+	clusterSetAccess          bool
+	placementAccess           bool
+	impersonation             bool
+
+	policyFile           string
+	policyMode           string
+	policyReloadInterval time.Duration
+
+	projectCacheTTL         time.Duration
+	projectCacheNegativeTTL time.Duration
+	projectCacheMaxEntries  int
+
+	telemetryListenAddress string
 }
 
 func main() {
@@ -38,8 +82,91 @@ func main() {
 
 	flagset.StringVar(&cfg.listenAddress, "listen-address",
 		defaultListenAddress, "The address HTTP server should listen on.")
+	flagset.StringVar(&cfg.tlsCertFile, "tls-cert-file", "",
+		"Path to the TLS certificate file of the proxy server. The server serves HTTP when it is unset.")
+	flagset.StringVar(&cfg.tlsKeyFile, "tls-private-key-file", "",
+		"Path to the TLS private key file of the proxy server.")
+	flagset.StringVar(&cfg.clientCAFile, "client-ca-file", "",
+		"Path to the CA bundle which verifies the client certificates of the TLS server. The requests without "+
+			"token are authenticated with the client certificates, the common name is the user and the "+
+			"organizations are the groups, their access is granted by the policy file.")
 	flagset.StringVar(&cfg.metricServer, "metrics-server", "",
 		"The address the metrics server should run on.")
+	flagset.BoolVar(&cfg.strictQueryRewrite, "strict-query-rewrite", true,
+		"Reject the queries which cannot be rewritten with the cluster filters.")
+	flagset.BoolVar(&cfg.responseFiltering, "response-filtering", true,
+		"Drop the series of the inaccessible clusters from the upstream query, series and exemplars responses.")
+	flagset.BoolVar(&cfg.negativeClusterMatcher, "negative-cluster-matcher", false,
+		"Express the cluster filter as the negative regex of the inaccessible clusters when it is shorter. "+
+			"The cluster matchers of the query are kept, and all the clusters stored upstream are excluded as well, "+
+			"the negative regex is only used once the cluster label values are loaded from upstream.")
+	flagset.StringToStringVar(&cfg.routes, "routes", map[string]string{},
+		"Additional routes from the path patterns of APIs to the strategies: rewrite, post-filter, admin-only or passthrough. "+
+			"The longer patterns take precedence, and the requests to the APIs not found in the routes are denied.")
+	flagset.StringVar(&cfg.namespaceAccessFile, "namespace-access-file", "",
+		"Path to a yaml file which restricts users to the metrics of some namespaces on the managed clusters.")
+	flagset.BoolVar(&cfg.allowSeriesWithoutNamespace, "allow-series-without-namespace", false,
+		"Allow the users with namespace level access to query the series without namespace label.")
+	flagset.StringVar(&cfg.authenticator, "authenticator", "openshift",
+		"The way to resolve the user of the request token: openshift uses the user API of OpenShift, "+
+			"tokenreview uses the TokenReview API of kubernetes, oidc validates the OIDC tokens locally with the JWKS.")
+	flagset.StringVar(&cfg.oidcIssuer, "oidc-issuer", "",
+		"The issuer of the OIDC tokens, which must match the iss claim.")
+	flagset.StringVar(&cfg.oidcAudience, "oidc-audience", "",
+		"The audience which the aud claim of the OIDC tokens must contain, e.g. the client id.")
+	flagset.StringVar(&cfg.oidcJWKSFile, "oidc-jwks-file", "",
+		"Path to the JWKS file with the signing keys of the OIDC issuer.")
+	flagset.StringVar(&cfg.oidcJWKSURL, "oidc-jwks-url", "",
+		"The url of the JWKS of the OIDC issuer, it is reloaded when the tokens are signed with unknown keys.")
+	flagset.StringVar(&cfg.oidcUsernameClaim, "oidc-username-claim", "sub",
+		"The claim of the OIDC tokens which is used as the user name.")
+	flagset.StringVar(&cfg.oidcUsernamePrefix, "oidc-username-prefix", "oidc:",
+		"The prefix of the user names of the OIDC tokens, so that they do not collide with the users of the hub. "+
+			"An empty prefix uses the user names as they are.")
+	flagset.StringVar(&cfg.oidcGroupsPrefix, "oidc-groups-prefix", "oidc:",
+		"The prefix of the groups of the OIDC tokens, so that they do not collide with the groups of the hub. "+
+			"An empty prefix uses the groups as they are.")
+	flagset.StringVar(&cfg.oidcGroupsClaim, "oidc-groups-claim", "",
+		"The claim of the OIDC tokens which is used as the groups of the user.")
+	flagset.StringVar(&cfg.clusterAuthorization, "cluster-authorization", "project",
+		"The way to decide the accessible clusters of the user: project matches the OpenShift projects of the user "+
+			"to the managed clusters, subjectaccessreview reviews the access of the user to each managed cluster.")
+	flagset.StringVar(&cfg.accessReviewVerb, "access-review-verb", "get",
+		"The verb on the managed clusters which is reviewed in the subjectaccessreview cluster authorization.")
+	flagset.StringVar(&cfg.accessReviewSubresource, "access-review-subresource", "",
+		"The subresource of the managed clusters which is reviewed in the subjectaccessreview cluster authorization.")
+	flagset.DurationVar(&cfg.accessReviewCacheDuration, "access-review-cache-duration", 5*time.Minute,
+		"How long the decisions of the access reviews are cached.")
+	flagset.BoolVar(&cfg.clusterSetAccess, "cluster-set-access", false,
+		"Grant the users who can get a ManagedClusterSet access to all member clusters of the set.")
+	flagset.BoolVar(&cfg.placementAccess, "placement-access", false,
+		"Grant the users who can get a Placement or its PlacementDecisions access to the clusters selected by the decisions.")
+	flagset.StringVar(&cfg.policyFile, "policy-file", "",
+		"Path to a yaml file of the access policy which grants users, groups and service accounts access to "+
+			"the metrics of clusters, namespaces and metric names. The file is reloaded when it is changed.")
+	flagset.StringVar(&cfg.policyMode, "policy-mode", util.PolicyModeUnion,
+		"How the access policy is combined with the accessible clusters of the user: union grants the clusters "+
+			"of the policy in addition, intersection restricts the accessible clusters to the clusters of the policy.")
+	flagset.DurationVar(&cfg.policyReloadInterval, "policy-reload-interval", 30*time.Second,
+		"How often the policy file is checked for changes.")
+	flagset.BoolVar(&cfg.impersonation, "impersonation", false,
+		"Allow the users who can impersonate the users and groups to send the Impersonate-User and Impersonate-Group "+
+			"headers, so that the requests are evaluated as the impersonated users. The impersonations are audited in the log. "+
+			"Without Impersonate-Group, the OpenShift groups of the impersonated user are used with the openshift "+
+			"authenticator, the impersonated user has no groups with the other authenticators.")
+	flagset.DurationVar(&cfg.projectCacheTTL, "project-cache-ttl", 24*time.Hour,
+		"How long the projects of the users are cached.")
+	flagset.DurationVar(&cfg.projectCacheNegativeTTL, "project-cache-negative-ttl", time.Minute,
+		"How long the users without project are cached, 0 disables the caching of the users without project.")
+	flagset.IntVar(&cfg.projectCacheMaxEntries, "project-cache-max-entries", 10000,
+		"The maximum number of the users cached in the project cache, the least recently used users are evicted. "+
+			"0 does not limit the number.")
+	flagset.StringVar(&cfg.telemetryListenAddress, "telemetry-listen-address", "",
+		"The address the HTTP server of the metrics of the proxy itself should listen on, e.g. 0.0.0.0:8081. "+
+			"The metrics are served on /metrics, and the server is disabled when it is unset.")
+	flagset.BoolVar(&cfg.trustForwardedGroups, "trust-forwarded-groups", false,
+		"Trust the X-Forwarded-User and X-Forwarded-Groups headers set by the front end, e.g. oauth-proxy. "+
+			"Otherwise the user and groups are the identity of the token resolved by the authenticator.")
 
 	_ = flagset.Parse(os.Args[1:])
 	if err := os.Setenv("METRICS_SERVER", cfg.metricServer); err != nil {
@@ -53,6 +180,98 @@ func main() {
 	klog.Infof("proxy server will running on: %s", cfg.listenAddress)
 	klog.Infof("metrics server is: %s", cfg.metricServer)
 	klog.Infof("kubeconfig is: %s", cfg.kubeconfigLocation)
+	klog.Infof("strict query rewrite is: %v", cfg.strictQueryRewrite)
+	util.SetStrictQueryRewrite(cfg.strictQueryRewrite)
+	klog.Infof("response filtering is: %v", cfg.responseFiltering)
+	proxy.SetResponseFiltering(cfg.responseFiltering)
+	klog.Infof("negative cluster matcher is: %v", cfg.negativeClusterMatcher)
+	util.SetNegativeClusterMatcher(cfg.negativeClusterMatcher)
+	if err := proxy.AddRoutes(cfg.routes); err != nil {
+		klog.Fatalf("failed to add routes: %v", err)
+	}
+
+	if cfg.namespaceAccessFile != "" {
+		klog.Infof("namespace access file is: %s", cfg.namespaceAccessFile)
+		if err := util.LoadNamespaceAccess(cfg.namespaceAccessFile); err != nil {
+			klog.Fatalf("failed to load namespace access: %v", err)
+		}
+	}
+	// the namespaces are also granted by the policy file
+	klog.Infof("allow series without namespace is: %v", cfg.allowSeriesWithoutNamespace)
+	util.SetAllowSeriesWithoutNamespace(cfg.allowSeriesWithoutNamespace)
+
+	if cfg.policyFile != "" {
+		klog.Infof("policy file is: %s, policy mode is: %s", cfg.policyFile, cfg.policyMode)
+		if err := util.SetPolicyMode(cfg.policyMode); err != nil {
+			klog.Fatalf("failed to set policy mode: %v", err)
+		}
+		if err := util.LoadPolicyFile(cfg.policyFile); err != nil {
+			klog.Fatalf("failed to load policy file: %v", err)
+		}
+		go util.WatchPolicyFile(cfg.policyFile, cfg.policyReloadInterval)
+	}
+
+	klog.Infof("trust forwarded groups is: %v", cfg.trustForwardedGroups)
+	util.SetTrustForwardedGroups(cfg.trustForwardedGroups)
+	klog.Infof("authenticator is: %s", cfg.authenticator)
+	switch cfg.authenticator {
+	case "openshift":
+		// the groups of the impersonated users are only known from the OpenShift groups
+		proxy.SetImpersonatedGroupsResolution(true)
+	case "tokenreview":
+		kubeClient, err := kubernetes.NewForConfig(config.GetConfigOrDie())
+		if err != nil {
+			klog.Fatalf("failed to new kubernetes clientset: %v", err)
+		}
+		proxy.SetAuthenticator(util.NewTokenReviewAuthenticator(kubeClient))
+	case "oidc":
+		klog.Infof("oidc issuer is: %s, audience is: %s", cfg.oidcIssuer, cfg.oidcAudience)
+		klog.Infof("oidc username prefix is: %q, groups prefix is: %q", cfg.oidcUsernamePrefix, cfg.oidcGroupsPrefix)
+		jwtAuthenticator, err := util.NewJWTAuthenticator(util.JWTAuthenticatorConfig{
+			Issuer:         cfg.oidcIssuer,
+			Audience:       cfg.oidcAudience,
+			JWKSFile:       cfg.oidcJWKSFile,
+			JWKSURL:        cfg.oidcJWKSURL,
+			UsernameClaim:  cfg.oidcUsernameClaim,
+			UsernamePrefix: cfg.oidcUsernamePrefix,
+			GroupsClaim:    cfg.oidcGroupsClaim,
+			GroupsPrefix:   cfg.oidcGroupsPrefix,
+		})
+		if err != nil {
+			klog.Fatalf("failed to create oidc authenticator: %v", err)
+		}
+		proxy.SetAuthenticator(jwtAuthenticator)
+	default:
+		klog.Fatalf("unsupported authenticator: %s", cfg.authenticator)
+	}
+
+	klog.Infof("cluster authorization is: %s", cfg.clusterAuthorization)
+	var reviewer *util.AccessReviewer
+	if cfg.clusterAuthorization == "subjectaccessreview" || cfg.clusterSetAccess || cfg.placementAccess || cfg.impersonation {
+		klog.Infof("access review verb is: %s, subresource is: %s", cfg.accessReviewVerb, cfg.accessReviewSubresource)
+		reviewer = util.NewAccessReviewer(config.GetConfigOrDie(), cfg.accessReviewVerb,
+			cfg.accessReviewSubresource, cfg.accessReviewCacheDuration)
+		go reviewer.CleanExpiredDecisions(cfg.accessReviewCacheDuration)
+	}
+	switch cfg.clusterAuthorization {
+	case "project":
+	case "subjectaccessreview":
+		util.SetAccessReviewer(reviewer)
+	default:
+		klog.Fatalf("unsupported cluster authorization: %s", cfg.clusterAuthorization)
+	}
+	klog.Infof("cluster set access is: %v", cfg.clusterSetAccess)
+	if cfg.clusterSetAccess {
+		util.SetClusterSetReviewer(reviewer)
+	}
+	klog.Infof("impersonation is: %v", cfg.impersonation)
+	if cfg.impersonation {
+		util.SetImpersonationReviewer(reviewer)
+	}
+	klog.Infof("placement access is: %v", cfg.placementAccess)
+	if cfg.placementAccess {
+		util.SetPlacementReviewer(reviewer)
+	}
 
 	clusterClient, err := clusterclientset.NewForConfig(config.GetConfigOrDie())
 	if err != nil {
@@ -61,10 +280,56 @@ func main() {
 
 	// watch all managed clusters
 	go util.WatchManagedCluster(clusterClient)
-	go util.CleanExpiredProjectInfo(24 * 60 * 60)
+	if cfg.placementAccess {
+		// watch the decisions of all placements
+		go util.WatchPlacementDecisions(clusterClient)
+	}
+	klog.Infof("project cache ttl is: %v, negative ttl is: %v, max entries is: %v",
+		cfg.projectCacheTTL, cfg.projectCacheNegativeTTL, cfg.projectCacheMaxEntries)
+	util.SetProjectCacheConfig(cfg.projectCacheTTL, cfg.projectCacheNegativeTTL, cfg.projectCacheMaxEntries)
+	go util.CleanExpiredProjectInfo(time.Minute)
+	if cfg.negativeClusterMatcher {
+		go proxy.WatchUpstreamClusterNames(5 * time.Minute)
+	}
+	if cfg.telemetryListenAddress != "" {
+		klog.Infof("telemetry server will running on: %s", cfg.telemetryListenAddress)
+		go serveTelemetry(cfg.telemetryListenAddress)
+	}
 
 	http.HandleFunc("/", proxy.HandleRequestAndRedirect)
-	if err := http.ListenAndServe(cfg.listenAddress, nil); err != nil {
-		klog.Fatalf("failed to ListenAndServe: %v", err)
+	if cfg.tlsCertFile == "" && cfg.tlsKeyFile == "" {
+		if cfg.clientCAFile != "" {
+			klog.Fatalf("client ca file requires the TLS certificate and private key files")
+		}
+		if err := http.ListenAndServe(cfg.listenAddress, nil); err != nil {
+			klog.Fatalf("failed to ListenAndServe: %v", err)
+		}
+		return
+	}
+
+	klog.Infof("tls cert file is: %s, client ca file is: %s", cfg.tlsCertFile, cfg.clientCAFile)
+	tlsConfig, err := proxy.NewServerTLSConfig(cfg.clientCAFile)
+	if err != nil {
+		klog.Fatalf("failed to create server tls config: %v", err)
+	}
+	server := &http.Server{
+		Addr:      cfg.listenAddress,
+		TLSConfig: tlsConfig,
+	}
+	if err := server.ListenAndServeTLS(cfg.tlsCertFile, cfg.tlsKeyFile); err != nil {
+		klog.Fatalf("failed to ListenAndServeTLS: %v", err)
+	}
+}
+
+// serveTelemetry serves the metrics of the proxy itself, e.g. the counters of the project cache
+func serveTelemetry(listenAddress string) {
+	registry := prometheus.NewRegistry()
+	if err := util.RegisterProjectCacheMetrics(registry); err != nil {
+		klog.Fatalf("failed to register project cache metrics: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	if err := http.ListenAndServe(listenAddress, mux); err != nil {
+		klog.Fatalf("failed to ListenAndServe telemetry: %v", err)
 	}
 }
@@ -0,0 +1,446 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// seriesFilter checks whether the series with the labels can be returned to the user
+type seriesFilter func(lbls map[string]string) bool
+
+// responseTransformer streams the response body from r to w, the number of dropped items is returned
+type responseTransformer func(r io.Reader, w io.Writer) (int, error)
+
+// newResponseFilter returns the ModifyResponse func of the reverse proxy, which drops the series
+// not accepted by the filter from the query, query_range, series and exemplars responses of upstream,
+// the alerts not accepted by the filter from the alerts and rules responses, and the metadata of
+// the targets not accepted by the filter from the targets metadata responses
+func newResponseFilter(userName string, filter seriesFilter) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			return nil
+		}
+		apiPath := resp.Request.URL.Path
+		transform := getResponseTransformer(apiPath, filter)
+		if transform == nil {
+			return nil
+		}
+
+		upstreamBody := resp.Body
+		var body io.Reader = upstreamBody
+		gzipped := resp.Header.Get("Content-Encoding") == "gzip"
+		if gzipped {
+			gr, err := gzip.NewReader(upstreamBody)
+			if err != nil {
+				return fmt.Errorf("failed to create gzip reader: %v", err)
+			}
+			body = gr
+		}
+
+		pr, pw := io.Pipe()
+		go func() {
+			defer upstreamBody.Close()
+			var w io.Writer = pw
+			var gw *gzip.Writer
+			if gzipped {
+				gw = gzip.NewWriter(pw)
+				w = gw
+			}
+
+			dropped, err := transform(body, w)
+			if err == nil && gw != nil {
+				err = gw.Close()
+			}
+			if dropped > 0 {
+				klog.Warningf("dropped %v items not accessible by user <%v> from the response of %v",
+					dropped, userName, apiPath)
+			}
+			_ = pw.CloseWithError(err)
+		}()
+
+		resp.Body = pr
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return nil
+	}
+}
+
+// getResponseTransformer returns the transformer which filters the response of the api,
+// nil is returned when the response of the api is not filtered
+func getResponseTransformer(apiPath string, filter seriesFilter) responseTransformer {
+	switch {
+	case !responseFiltering && isSeriesAPIPath(apiPath):
+		return nil
+	case strings.HasSuffix(apiPath, "/api/v1/query"), strings.HasSuffix(apiPath, "/api/v1/query_range"):
+		return func(r io.Reader, w io.Writer) (int, error) {
+			return filterSeries(r, w, false, filter)
+		}
+	case strings.HasSuffix(apiPath, "/api/v1/series"):
+		return func(r io.Reader, w io.Writer) (int, error) {
+			return filterSeries(r, w, true, filter)
+		}
+	case strings.HasSuffix(apiPath, "/api/v1/query_exemplars"):
+		return func(r io.Reader, w io.Writer) (int, error) {
+			return filterDataArray(r, w, filter, func(raw json.RawMessage) (map[string]string, error) {
+				exemplars := struct {
+					SeriesLabels map[string]string `json:"seriesLabels"`
+				}{}
+				return exemplars.SeriesLabels, json.Unmarshal(raw, &exemplars)
+			})
+		}
+	case strings.HasSuffix(apiPath, "/api/v1/alerts"):
+		return func(r io.Reader, w io.Writer) (int, error) {
+			return filterAlerts(r, w, newClusterLabelFilter(filter))
+		}
+	case strings.HasSuffix(apiPath, "/api/v1/rules"):
+		return func(r io.Reader, w io.Writer) (int, error) {
+			return filterRules(r, w, newClusterLabelFilter(filter))
+		}
+	case strings.HasSuffix(apiPath, "/api/v1/targets/metadata"):
+		return func(r io.Reader, w io.Writer) (int, error) {
+			return filterDataArray(r, w, newClusterLabelFilter(filter), func(raw json.RawMessage) (map[string]string, error) {
+				metadata := struct {
+					Target map[string]string `json:"target"`
+				}{}
+				return metadata.Target, json.Unmarshal(raw, &metadata)
+			})
+		}
+	default:
+		return nil
+	}
+}
+
+func isSeriesAPIPath(apiPath string) bool {
+	return strings.HasSuffix(apiPath, "/api/v1/query") ||
+		strings.HasSuffix(apiPath, "/api/v1/query_range") ||
+		strings.HasSuffix(apiPath, "/api/v1/series") ||
+		strings.HasSuffix(apiPath, "/api/v1/query_exemplars")
+}
+
+// newClusterLabelFilter returns the filter for alerts and targets, unlike the series
+// of queries the alerts and targets without cluster label are dropped
+func newClusterLabelFilter(filter seriesFilter) seriesFilter {
+	return func(lbls map[string]string) bool {
+		_, ok := lbls["cluster"]
+		return ok && filter(lbls)
+	}
+}
+
+// filterSeries streams the prometheus API response from r to w, the series in the data of the
+// response are dropped unless they are accepted by the filter, the number of dropped series is returned
+func filterSeries(r io.Reader, w io.Writer, seriesAPI bool, filter seriesFilter) (int, error) {
+	dec := json.NewDecoder(r)
+	bw := bufio.NewWriter(w)
+	dropped := 0
+
+	err := transformObject(dec, bw, func(key string) (bool, error) {
+		if key != "data" {
+			return false, nil
+		}
+
+		// the series api returns the series in the data array, and the query apis
+		// return the series in the result array of the data object
+		if seriesAPI {
+			n, err := transformSeriesArray(dec, bw, filter, func(raw json.RawMessage) (map[string]string, error) {
+				lbls := map[string]string{}
+				return lbls, json.Unmarshal(raw, &lbls)
+			})
+			dropped += n
+			return true, err
+		}
+
+		return true, transformObject(dec, bw, func(key string) (bool, error) {
+			if key != "result" {
+				return false, nil
+			}
+			n, err := transformSeriesArray(dec, bw, filter, func(raw json.RawMessage) (map[string]string, error) {
+				series := struct {
+					Metric map[string]string `json:"metric"`
+				}{}
+				return series.Metric, json.Unmarshal(raw, &series)
+			})
+			dropped += n
+			return true, err
+		})
+	})
+	if err != nil {
+		return dropped, err
+	}
+	return dropped, bw.Flush()
+}
+
+// filterDataArray streams the prometheus API response from r to w, the elements of the data array
+// are dropped unless the labels returned by labelsFunc are accepted by the filter
+func filterDataArray(r io.Reader, w io.Writer, filter seriesFilter,
+	labelsFunc func(json.RawMessage) (map[string]string, error)) (int, error) {
+	dec := json.NewDecoder(r)
+	bw := bufio.NewWriter(w)
+	dropped := 0
+
+	err := transformObject(dec, bw, func(key string) (bool, error) {
+		if key != "data" {
+			return false, nil
+		}
+		n, err := transformSeriesArray(dec, bw, filter, labelsFunc)
+		dropped += n
+		return true, err
+	})
+	if err != nil {
+		return dropped, err
+	}
+	return dropped, bw.Flush()
+}
+
+// transformObject copies the json object from the decoder to w, the values are copied as is unless
+// transformValue returns true after transforming the value of the key by itself
+func transformObject(dec *json.Decoder, w *bufio.Writer, transformValue func(key string) (bool, error)) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	_ = w.WriteByte('{')
+
+	for idx := 0; dec.More(); idx++ {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := token.(string)
+		if !ok {
+			return fmt.Errorf("unexpected json token: %v", token)
+		}
+		if idx > 0 {
+			_ = w.WriteByte(',')
+		}
+		if err := writeJSON(w, key); err != nil {
+			return err
+		}
+		_ = w.WriteByte(':')
+
+		transformed, err := transformValue(key)
+		if err != nil {
+			return err
+		}
+		if !transformed {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return err
+			}
+			_, _ = w.Write(raw)
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return err
+	}
+	return w.WriteByte('}')
+}
+
+// transformSeriesArray copies the json array from the decoder to w, the series which are not
+// accepted by the filter are dropped. The elements which are not objects, e.g. the value of a
+// scalar result, are copied as is
+func transformSeriesArray(dec *json.Decoder, w *bufio.Writer, filter seriesFilter,
+	labelsFunc func(json.RawMessage) (map[string]string, error)) (int, error) {
+	if err := expectDelim(dec, '['); err != nil {
+		return 0, err
+	}
+	_ = w.WriteByte('[')
+
+	dropped, written := 0, 0
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return dropped, err
+		}
+
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+			lbls, err := labelsFunc(raw)
+			if err != nil {
+				return dropped, err
+			}
+			if !filter(lbls) {
+				dropped++
+				continue
+			}
+		}
+
+		if written > 0 {
+			_ = w.WriteByte(',')
+		}
+		_, _ = w.Write(raw)
+		written++
+	}
+
+	if err := expectDelim(dec, ']'); err != nil {
+		return dropped, err
+	}
+	return dropped, w.WriteByte(']')
+}
+
+// filterAlerts streams the alerts API response from r to w, the alerts in the data of the
+// response are dropped unless they are accepted by the filter
+func filterAlerts(r io.Reader, w io.Writer, filter seriesFilter) (int, error) {
+	dropped := 0
+	err := transformData(r, w, "alerts", func(dec *json.Decoder, w *bufio.Writer) error {
+		alerts := []map[string]json.RawMessage{}
+		if err := dec.Decode(&alerts); err != nil {
+			return err
+		}
+		alerts, n, err := filterAlertList(alerts, filter)
+		if err != nil {
+			return err
+		}
+		dropped += n
+		return writeJSON(w, alerts)
+	})
+	return dropped, err
+}
+
+// filterRules streams the rules API response from r to w, the alerts of the alerting rules are dropped
+// unless they are accepted by the filter. The rules are trimmed to the alerting rules with accepted alerts,
+// and the groups without rule are dropped
+func filterRules(r io.Reader, w io.Writer, filter seriesFilter) (int, error) {
+	dropped := 0
+	err := transformData(r, w, "groups", func(dec *json.Decoder, w *bufio.Writer) error {
+		groups := []map[string]json.RawMessage{}
+		if err := dec.Decode(&groups); err != nil {
+			return err
+		}
+
+		filteredGroups := []map[string]json.RawMessage{}
+		for _, group := range groups {
+			rules := []map[string]json.RawMessage{}
+			if err := json.Unmarshal(group["rules"], &rules); err != nil {
+				return err
+			}
+
+			filteredRules := []map[string]json.RawMessage{}
+			for _, rule := range rules {
+				alerts := []map[string]json.RawMessage{}
+				if err := unmarshalOptional(rule["alerts"], &alerts); err != nil {
+					return err
+				}
+				alerts, n, err := filterAlertList(alerts, filter)
+				if err != nil {
+					return err
+				}
+				dropped += n
+				if len(alerts) == 0 {
+					continue
+				}
+
+				if rule["alerts"], err = json.Marshal(alerts); err != nil {
+					return err
+				}
+				if rule["state"], err = json.Marshal(alertingRuleState(alerts)); err != nil {
+					return err
+				}
+				filteredRules = append(filteredRules, rule)
+			}
+			if len(filteredRules) == 0 {
+				continue
+			}
+
+			var err error
+			if group["rules"], err = json.Marshal(filteredRules); err != nil {
+				return err
+			}
+			filteredGroups = append(filteredGroups, group)
+		}
+		return writeJSON(w, filteredGroups)
+	})
+	return dropped, err
+}
+
+// transformData streams the prometheus API response from r to w, the value of the key
+// in the data object of the response is transformed by transformValue
+func transformData(r io.Reader, w io.Writer, key string, transformValue func(*json.Decoder, *bufio.Writer) error) error {
+	dec := json.NewDecoder(r)
+	bw := bufio.NewWriter(w)
+	err := transformObject(dec, bw, func(dataKey string) (bool, error) {
+		if dataKey != "data" {
+			return false, nil
+		}
+		return true, transformObject(dec, bw, func(valueKey string) (bool, error) {
+			if valueKey != key {
+				return false, nil
+			}
+			return true, transformValue(dec, bw)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// filterAlertList returns the alerts accepted by the filter and the number of dropped alerts
+func filterAlertList(alerts []map[string]json.RawMessage, filter seriesFilter) ([]map[string]json.RawMessage, int, error) {
+	filteredAlerts := []map[string]json.RawMessage{}
+	for _, alert := range alerts {
+		lbls := map[string]string{}
+		if err := unmarshalOptional(alert["labels"], &lbls); err != nil {
+			return nil, 0, err
+		}
+		if filter(lbls) {
+			filteredAlerts = append(filteredAlerts, alert)
+		}
+	}
+	return filteredAlerts, len(alerts) - len(filteredAlerts), nil
+}
+
+// alertingRuleState returns the state of the alerting rule with the alerts
+func alertingRuleState(alerts []map[string]json.RawMessage) string {
+	state := "inactive"
+	for _, alert := range alerts {
+		var alertState string
+		if err := unmarshalOptional(alert["state"], &alertState); err != nil {
+			continue
+		}
+		if alertState == "firing" {
+			return "firing"
+		}
+		if alertState == "pending" {
+			state = "pending"
+		}
+	}
+	return state
+}
+
+// unmarshalOptional unmarshals the json value unless it is missing
+func unmarshalOptional(data json.RawMessage, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("unexpected json token: %v, expected: %v", token, delim)
+	}
+	return nil
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func clusterFilter(lbls map[string]string) bool {
+	cluster, ok := lbls["cluster"]
+	return !ok || cluster == "c1"
+}
+
+func TestFilterSeries(t *testing.T) {
+	testCaseList := []struct {
+		name      string
+		seriesAPI bool
+		body      string
+		expected  string
+		dropped   int
+	}{
+		{
+			"vector result",
+			false,
+			`{"status":"success","data":{"resultType":"vector","result":[` +
+				`{"metric":{"__name__":"up","cluster":"c1"},"value":[1,"1"]},` +
+				`{"metric":{"__name__":"up","cluster":"c2"},"value":[1,"1"]},` +
+				`{"metric":{},"value":[1,"2"]}]}}`,
+			`{"status":"success","data":{"resultType":"vector","result":[` +
+				`{"metric":{"__name__":"up","cluster":"c1"},"value":[1,"1"]},` +
+				`{"metric":{},"value":[1,"2"]}]}}`,
+			1,
+		},
+		{
+			"matrix result with warnings",
+			false,
+			`{"status": "success", "data": {"resultType": "matrix", "result": [` +
+				`{"metric": {"cluster": "c2"}, "values": [[1, "1"], [2, "1"]]}]}, "warnings": ["w"]}`,
+			`{"status":"success","data":{"resultType":"matrix","result":[]},"warnings":["w"]}`,
+			1,
+		},
+		{
+			"scalar result",
+			false,
+			`{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`,
+			`{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`,
+			0,
+		},
+		{
+			"series result",
+			true,
+			`{"status":"success","data":[{"__name__":"up","cluster":"c2"},{"__name__":"up","cluster":"c1"}]}`,
+			`{"status":"success","data":[{"__name__":"up","cluster":"c1"}]}`,
+			1,
+		},
+	}
+
+	for _, c := range testCaseList {
+		var output bytes.Buffer
+		dropped, err := filterSeries(strings.NewReader(c.body), &output, c.seriesAPI, clusterFilter)
+		if err != nil {
+			t.Errorf("case (%v) failed to filter series: %v", c.name, err)
+		}
+		if output.String() != c.expected || dropped != c.dropped {
+			t.Errorf("case (%v) output: (%v, %v) is not the expected: (%v, %v)", c.name, output.String(), dropped, c.expected, c.dropped)
+		}
+	}
+
+	var output bytes.Buffer
+	if _, err := filterSeries(strings.NewReader(`{"data":`), &output, false, clusterFilter); err == nil {
+		t.Errorf("case (invalid json) should return error")
+	}
+}
+
+func TestNewResponseFilter(t *testing.T) {
+	body := `{"status":"success","data":[{"cluster":"c2"},{"cluster":"c1"}]}`
+	expected := `{"status":"success","data":[{"cluster":"c1"}]}`
+	testCaseList := []struct {
+		name      string
+		path      string
+		status    int
+		gzipped   bool
+		filtering bool
+		expected  string
+	}{
+		{"should filter series", basePath + "/api/v1/series", http.StatusOK, false, true, expected},
+		{"should filter gzipped series", basePath + "/api/v1/series", http.StatusOK, true, true, expected},
+		{"should not filter other api", basePath + "/api/v1/status/buildinfo", http.StatusOK, false, true, body},
+		{"should not filter error", basePath + "/api/v1/series", http.StatusBadRequest, false, true, body},
+		{"should not filter series when disabled", basePath + "/api/v1/series", http.StatusOK, false, false, body},
+	}
+
+	defer SetResponseFiltering(true)
+
+	for _, c := range testCaseList {
+		SetResponseFiltering(c.filtering)
+		var respBody bytes.Buffer
+		resp := &http.Response{
+			StatusCode: c.status,
+			Header:     make(http.Header),
+			Request:    &http.Request{URL: &url.URL{Path: c.path}},
+		}
+		if c.gzipped {
+			if err := gzipWrite(&respBody, []byte(body)); err != nil {
+				t.Errorf("case (%v) failed to compress: %v", c.name, err)
+			}
+			resp.Header.Set("Content-Encoding", "gzip")
+		} else {
+			respBody.WriteString(body)
+		}
+		resp.Body = ioutil.NopCloser(&respBody)
+
+		if err := newResponseFilter("test", clusterFilter)(resp); err != nil {
+			t.Errorf("case (%v) failed to filter response: %v", c.name, err)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Errorf("case (%v) failed to read response: %v", c.name, err)
+		}
+		if c.gzipped {
+			gr, err := gzip.NewReader(bytes.NewBuffer(data))
+			if err != nil {
+				t.Errorf("case (%v) failed to create gzip reader: %v", c.name, err)
+				continue
+			}
+			data, _ = ioutil.ReadAll(gr)
+		}
+		if string(data) != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, string(data), c.expected)
+		}
+	}
+}
+
+func TestFilterAlerts(t *testing.T) {
+	body := `{"status":"success","data":{"alerts":[` +
+		`{"labels":{"alertname":"a","cluster":"c1"},"state":"firing"},` +
+		`{"labels":{"alertname":"a","cluster":"c2"},"state":"firing"},` +
+		`{"labels":{"alertname":"b"},"state":"pending"}]}}`
+	expected := `{"status":"success","data":{"alerts":[` +
+		`{"labels":{"alertname":"a","cluster":"c1"},"state":"firing"}]}}`
+
+	var output bytes.Buffer
+	dropped, err := filterAlerts(strings.NewReader(body), &output, newClusterLabelFilter(clusterFilter))
+	if err != nil {
+		t.Errorf("failed to filter alerts: %v", err)
+	}
+	if output.String() != expected || dropped != 2 {
+		t.Errorf("output: (%v, %v) is not the expected: (%v, %v)", output.String(), dropped, expected, 2)
+	}
+}
+
+func TestFilterRules(t *testing.T) {
+	body := `{"status":"success","data":{"groups":[` +
+		`{"name":"g1","file":"f","interval":30,"rules":[` +
+		`{"type":"alerting","name":"a","state":"firing","alerts":[` +
+		`{"labels":{"alertname":"a","cluster":"c2"},"state":"firing"},` +
+		`{"labels":{"alertname":"a","cluster":"c1"},"state":"pending"}]},` +
+		`{"type":"alerting","name":"b","state":"inactive","alerts":[]},` +
+		`{"type":"recording","name":"r","query":"sum(up)"}]},` +
+		`{"name":"g2","file":"f","interval":30,"rules":[` +
+		`{"type":"alerting","name":"c","state":"firing","alerts":[` +
+		`{"labels":{"alertname":"c","cluster":"c2"},"state":"firing"}]}]}]}}`
+	expected := `{"status":"success","data":{"groups":[` +
+		`{"file":"f","interval":30,"name":"g1","rules":[` +
+		`{"alerts":[{"labels":{"alertname":"a","cluster":"c1"},"state":"pending"}],` +
+		`"name":"a","state":"pending","type":"alerting"}]}]}}`
+
+	var output bytes.Buffer
+	dropped, err := filterRules(strings.NewReader(body), &output, newClusterLabelFilter(clusterFilter))
+	if err != nil {
+		t.Errorf("failed to filter rules: %v", err)
+	}
+	if output.String() != expected || dropped != 2 {
+		t.Errorf("output: (%v, %v) is not the expected: (%v, %v)", output.String(), dropped, expected, 2)
+	}
+}
+
+func TestFilterDataArray(t *testing.T) {
+	testCaseList := []struct {
+		name     string
+		apiPath  string
+		body     string
+		expected string
+		dropped  int
+	}{
+		{
+			"exemplars",
+			basePath + "/api/v1/query_exemplars",
+			`{"status":"success","data":[` +
+				`{"seriesLabels":{"__name__":"foo","cluster":"c1"},"exemplars":[{"labels":{"traceID":"a"},"value":"1","timestamp":1}]},` +
+				`{"seriesLabels":{"__name__":"foo","cluster":"c2"},"exemplars":[{"labels":{"traceID":"b"},"value":"1","timestamp":1}]}]}`,
+			`{"status":"success","data":[` +
+				`{"seriesLabels":{"__name__":"foo","cluster":"c1"},"exemplars":[{"labels":{"traceID":"a"},"value":"1","timestamp":1}]}]}`,
+			1,
+		},
+		{
+			"targets metadata",
+			basePath + "/api/v1/targets/metadata",
+			`{"status":"success","data":[` +
+				`{"target":{"instance":"a","cluster":"c1"},"metric":"foo","type":"gauge","help":"h","unit":""},` +
+				`{"target":{"instance":"b","cluster":"c2"},"metric":"foo","type":"gauge","help":"h","unit":""},` +
+				`{"target":{"instance":"c"},"metric":"foo","type":"gauge","help":"h","unit":""}]}`,
+			`{"status":"success","data":[` +
+				`{"target":{"instance":"a","cluster":"c1"},"metric":"foo","type":"gauge","help":"h","unit":""}]}`,
+			2,
+		},
+	}
+
+	for _, c := range testCaseList {
+		var output bytes.Buffer
+		dropped, err := getResponseTransformer(c.apiPath, clusterFilter)(strings.NewReader(c.body), &output)
+		if err != nil {
+			t.Errorf("case (%v) failed to filter response: %v", c.name, err)
+		}
+		if output.String() != c.expected || dropped != c.dropped {
+			t.Errorf("case (%v) output: (%v, %v) is not the expected: (%v, %v)",
+				c.name, output.String(), dropped, c.expected, c.dropped)
+		}
+	}
+}
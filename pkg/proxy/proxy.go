@@ -6,7 +6,9 @@ package proxy
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -15,10 +17,14 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/prometheus/prometheus/promql/parser"
 	"k8s.io/klog"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 
+	"github.com/stolostron/rbac-query-proxy/pkg/rewrite"
 	"github.com/stolostron/rbac-query-proxy/pkg/util"
 )
 
@@ -26,13 +32,61 @@ const (
 	basePath        = "/api/metrics/v1/default"
 	projectsAPIPath = "/apis/project.openshift.io/v1/projects"
 	userAPIPath     = "/apis/user.openshift.io/v1/users/~"
+	groupsAPIPath   = "/apis/user.openshift.io/v1/groups"
+	// identityCacheDuration is how long the users resolved from the tokens are cached
+	identityCacheDuration = 5 * time.Minute
+	// identityCacheMaxEntries is the maximum number of the users resolved from the tokens which are cached
+	identityCacheMaxEntries = 10000
 )
 
 var (
 	serverScheme = ""
 	serverHost   = ""
+	// responseFiltering drops the series of the inaccessible clusters from the upstream query, series and
+	// exemplars responses, the alerts, rules and targets metadata responses are always filtered since their
+	// requests are not rewritten
+	responseFiltering = true
+	authenticator     util.Authenticator
+	authenticatorOnce sync.Once
+	// impersonatedGroupsResolution resolves the OpenShift groups of the users impersonated without groups
+	impersonatedGroupsResolution = false
 )
 
+// SetAuthenticator is used to set the authenticator which resolves the user of the request token,
+// the user API of OpenShift is used when it is not set. The resolved users are cached
+func SetAuthenticator(a util.Authenticator) {
+	// the default authenticator is not created once the authenticator is set
+	authenticatorOnce.Do(func() {})
+	authenticator = util.NewCachedAuthenticator(a, identityCacheDuration, identityCacheMaxEntries)
+}
+
+func getAuthenticator() util.Authenticator {
+	authenticatorOnce.Do(func() {
+		authenticator = util.NewCachedAuthenticator(
+			util.NewOpenShiftAuthenticator(config.GetConfigOrDie().Host+userAPIPath), identityCacheDuration,
+			identityCacheMaxEntries)
+	})
+	return authenticator
+}
+
+// SetImpersonatedGroupsResolution is used to enable or disable the resolution of the OpenShift groups of
+// the users impersonated without Impersonate-Group, it is only enabled with the OpenShift authenticator
+func SetImpersonatedGroupsResolution(enabled bool) {
+	impersonatedGroupsResolution = enabled
+}
+
+// SetResponseFiltering is used to enable or disable the filtering of upstream query and series responses
+func SetResponseFiltering(enabled bool) {
+	responseFiltering = enabled
+}
+
+// errorResponse is the prometheus API response for the failed requests
+type errorResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+}
+
 // HandleRequestAndRedirect is used to init proxy handler
 func HandleRequestAndRedirect(res http.ResponseWriter, req *http.Request) {
 	if preCheckRequest(req) != nil {
@@ -43,6 +97,13 @@ func HandleRequestAndRedirect(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	strategy, ok := findRouteStrategy(req.URL.Path)
+	if !ok {
+		klog.Warningf("denied request of user <%v> to unsupported api: %v", req.Header.Get("X-Forwarded-User"), req.URL.Path)
+		writeErrorResponse(res, http.StatusForbidden, "forbidden", fmt.Errorf("api %s is not allowed", req.URL.Path))
+		return
+	}
+
 	serverURL, err := url.Parse(os.Getenv("METRICS_SERVER"))
 	if err != nil {
 		klog.Errorf("failed to parse url: %v", err)
@@ -64,10 +125,93 @@ func HandleRequestAndRedirect(res http.ResponseWriter, req *http.Request) {
 	req.Header.Set("X-Forwarded-Host", req.Header.Get("Host"))
 	req.Host = serverURL.Host
 	req.URL.Path = path.Join(basePath, req.URL.Path)
-	util.ModifyMetricsQueryParams(req, config.GetConfigOrDie().Host+projectsAPIPath)
+	if strategy == passthroughStrategy {
+		proxy.ServeHTTP(res, req)
+		return
+	}
+
+	access := util.GetUserAccess(req, config.GetConfigOrDie().Host+projectsAPIPath)
+	if access.IsUnrestricted() {
+		proxy.ServeHTTP(res, req)
+		return
+	}
+
+	switch strategy {
+	case adminOnlyStrategy:
+		klog.Warningf("denied request of user <%v> to admin api: %v", access.UserName, req.URL.Path)
+		writeErrorResponse(res, http.StatusForbidden, "forbidden", errors.New("access to all clusters is required"))
+		return
+	case rewriteStrategy:
+		err = modifyRequest(req, access)
+		if errors.Is(err, rewrite.ErrEmptyResult) {
+			writeEmptyResultResponse(res, req.URL.Path, err)
+			return
+		}
+		if err != nil {
+			writeErrorResponse(res, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+	}
+
+	proxy.ModifyResponse = newResponseFilter(access.UserName, access.AllowsSeries)
 	proxy.ServeHTTP(res, req)
 }
 
+// modifyRequest rewrites the queries of the request with the accessible clusters
+func modifyRequest(req *http.Request, access *util.UserAccess) error {
+	if strings.HasSuffix(req.URL.Path, "/api/v1/read") {
+		return util.ModifyRemoteReadRequest(req, access)
+	}
+	return util.ModifyMetricsQueryParams(req, access)
+}
+
+// writeEmptyResultResponse writes the empty result for the api without sending the request to upstream,
+// the result type of the instant query is the type of the query of the empty result error
+func writeEmptyResultResponse(res http.ResponseWriter, apiPath string, err error) {
+	body := `{"status":"success","data":{"resultType":"matrix","result":[]}}`
+	switch {
+	case strings.HasSuffix(apiPath, "/api/v1/query"):
+		var emptyResultErr *rewrite.EmptyResultError
+		if !errors.As(err, &emptyResultErr) || emptyResultErr.ValueType != parser.ValueTypeMatrix {
+			body = `{"status":"success","data":{"resultType":"vector","result":[]}}`
+		}
+	case strings.HasSuffix(apiPath, "/api/v1/series"),
+		strings.HasSuffix(apiPath, "/api/v1/labels"),
+		strings.HasSuffix(apiPath, "/values"),
+		strings.HasSuffix(apiPath, "/api/v1/query_exemplars"):
+		body = `{"status":"success","data":[]}`
+	case strings.HasSuffix(apiPath, "/federate"):
+		// the federate api returns the series in the text exposition format
+		res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	if _, err := res.Write([]byte(body)); err != nil {
+		klog.Errorf("failed to write response: %v", err)
+	}
+}
+
+// writeErrorResponse writes the error in the prometheus API response format
+func writeErrorResponse(res http.ResponseWriter, status int, errorType string, err error) {
+	body, jsonErr := json.Marshal(errorResponse{
+		Status:    "error",
+		ErrorType: errorType,
+		Error:     err.Error(),
+	})
+	if jsonErr != nil {
+		klog.Errorf("failed to marshal error response: %v", jsonErr)
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	if _, err := res.Write(body); err != nil {
+		klog.Errorf("failed to write response: %v", err)
+	}
+}
+
 func errorHandle(rw http.ResponseWriter, req *http.Request, err error) {
 	token := req.Header.Get("X-Forwarded-Access-Token")
 	if token == "" {
@@ -80,36 +224,122 @@ func preCheckRequest(req *http.Request) error {
 	if token == "" {
 		token = req.Header.Get("Authorization")
 		if token == "" {
+			// the requests without token can be authenticated with the client certificates
+			if user, ok := util.GetClientCertUser(req); ok {
+				return preCheckClientCertRequest(req, user)
+			}
 			return errors.New("found unauthorized user")
 		} else {
 			req.Header.Set("X-Forwarded-Access-Token", token)
 		}
 	}
 
-	userName := req.Header.Get("X-Forwarded-User")
-	if userName == "" {
-		userName = util.GetUserName(token, config.GetConfigOrDie().Host+userAPIPath)
-		if userName == "" {
-			return errors.New("failed to found user name")
-		} else {
-			req.Header.Set("X-Forwarded-User", userName)
+	user, err := authenticateRequest(req, token)
+	if err != nil {
+		return err
+	}
+	klog.V(1).Infof("user <%v> is in groups: %v", user.Name, user.Groups)
+	req.Header.Set("X-Forwarded-User", user.Name)
+	util.SetForwardedGroups(req, user.Groups)
+
+	if imp := util.GetImpersonation(req); imp != nil {
+		return preCheckImpersonation(req, token, user, imp)
+	}
+
+	// the projects are not required when the accessible clusters are decided with access reviews
+	if util.UsesAccessReview() {
+		if len(util.GetAllManagedClusterNames()) == 0 {
+			return errors.New("no cluster found")
 		}
+		return nil
 	}
 
 	projectList, ok := util.GetUserProjectList(token)
 	if !ok {
 		projectList = util.FetchUserProjectList(token, config.GetConfigOrDie().Host+projectsAPIPath)
-		up := util.NewUserProject(userName, token, projectList)
-		util.UpdateUserProject(up)
+		up := util.NewUserProject(user.Name, projectList)
+		util.UpdateUserProject(token, up)
 	}
 
-	if len(projectList) == 0 || len(util.GetAllManagedClusterNames()) == 0 {
+	// the users without project can still access the clusters granted by the policy
+	if (len(projectList) == 0 && !util.HasPolicyGrant(user)) || len(util.GetAllManagedClusterNames()) == 0 {
 		return errors.New("no project or cluster found")
 	}
 
 	return nil
 }
 
+// authenticateRequest returns the user and groups of the token, the user and groups forwarded by the front
+// end are used as is when they are trusted. The request is rejected when the token cannot be authenticated
+func authenticateRequest(req *http.Request, token string) (*util.UserInfo, error) {
+	userName := req.Header.Get("X-Forwarded-User")
+	if userName != "" && util.TrustsForwardedGroups() {
+		return &util.UserInfo{Name: userName, Groups: util.GetForwardedGroups(req)}, nil
+	}
+
+	user, err := getAuthenticator().Authenticate(token)
+	if err != nil {
+		klog.Errorf("failed to authenticate user: %v", err)
+		return nil, errors.New("failed to found user name")
+	}
+	if userName != "" && userName != user.Name {
+		klog.Warningf("forwarded user <%v> is replaced with the authenticated user <%v>", userName, user.Name)
+	}
+	if util.TrustsForwardedGroups() {
+		return &util.UserInfo{Name: user.Name, Groups: util.GetForwardedGroups(req), Expiry: user.Expiry}, nil
+	}
+	return user, nil
+}
+
+// preCheckImpersonation authorizes the user to impersonate the user and groups of the impersonation headers,
+// and replaces the user and groups headers with the impersonated ones, so that the request is evaluated
+// exactly as the impersonated user. Every impersonation is recorded in the audit log. Without Impersonate-Group,
+// the OpenShift groups of the impersonated user are resolved and authorized as well when the resolution is
+// enabled; otherwise the impersonated user has no groups, like in the api server
+func preCheckImpersonation(req *http.Request, token string, user *util.UserInfo, imp *util.Impersonation) error {
+	if impersonatedGroupsResolution {
+		if err := util.ResolveImpersonatedGroups(token, imp, config.GetConfigOrDie().Host+groupsAPIPath); err != nil {
+			klog.Warningf("impersonation audit: denied user <%v> in groups %v to impersonate user <%v>: %v",
+				user.Name, user.Groups, imp.UserName, err)
+			return err
+		}
+		// the resolved groups are evaluated from the headers as the groups sent by the admin
+		util.SetImpersonation(req, imp)
+	}
+	if err := util.AuthorizeImpersonation(token, imp); err != nil {
+		klog.Warningf("impersonation audit: denied user <%v> in groups %v to impersonate user <%v> in groups %v: %v",
+			user.Name, user.Groups, imp.UserName, imp.Groups, err)
+		return err
+	}
+	klog.Infof("impersonation audit: user <%v> in groups %v impersonates user <%v> in groups %v for %v %v",
+		user.Name, user.Groups, imp.UserName, imp.Groups, req.Method, req.URL.Path)
+	req.Header.Set("X-Forwarded-User", imp.UserName)
+	util.SetForwardedGroups(req, imp.Groups)
+
+	// the projects of the impersonated user are not required, so that the empty access can be troubleshot
+	if len(util.GetAllManagedClusterNames()) == 0 {
+		return errors.New("no cluster found")
+	}
+	return nil
+}
+
+// preCheckClientCertRequest replaces the user and groups headers with the identity of the client certificate,
+// the user has no project, so the accessible clusters are only granted by the access policy
+func preCheckClientCertRequest(req *http.Request, user *util.UserInfo) error {
+	// the impersonation is reviewed with the token of the user
+	if util.GetImpersonation(req) != nil {
+		return errors.New("impersonation requires token")
+	}
+	klog.V(1).Infof("user <%v> in groups %v is authenticated by client certificate", user.Name, user.Groups)
+	req.Header.Set("X-Forwarded-User", user.Name)
+	util.SetForwardedGroups(req, user.Groups)
+
+	if !util.HasPolicyGrant(user) || len(util.GetAllManagedClusterNames()) == 0 {
+		return errors.New("no policy or cluster found")
+	}
+	return nil
+}
+
 func newEmptyMatrixHTTPBody() []byte {
 	var bodyBuff bytes.Buffer
 	gz := gzip.NewWriter(&bodyBuff)
@@ -143,6 +373,8 @@ func gzipWrite(w io.Writer, data []byte) error {
 func proxyRequest(r *http.Request) {
 	r.URL.Scheme = serverScheme
 	r.URL.Host = serverHost
+	// the impersonation is handled by the proxy, it is not sent to upstream
+	util.RemoveImpersonation(r)
 	if r.Method == http.MethodGet {
 		if strings.HasSuffix(r.URL.Path, "/api/v1/query") ||
 			strings.HasSuffix(r.URL.Path, "/api/v1/query_range") ||
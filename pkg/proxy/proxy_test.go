@@ -6,13 +6,27 @@ package proxy
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/prometheus/promql/parser"
+	"k8s.io/client-go/rest"
+
+	"github.com/stolostron/rbac-query-proxy/pkg/rewrite"
 	"github.com/stolostron/rbac-query-proxy/pkg/util"
 )
 
@@ -78,7 +92,56 @@ func TestErrorHandle(t *testing.T) {
 	}
 }
 
+func TestWriteEmptyResultResponse(t *testing.T) {
+	vectorErr := &rewrite.EmptyResultError{ValueType: parser.ValueTypeVector}
+	matrixErr := &rewrite.EmptyResultError{ValueType: parser.ValueTypeMatrix}
+	testCaseList := []struct {
+		name     string
+		apiPath  string
+		err      error
+		expected string
+	}{
+		{"query api", basePath + "/api/v1/query", vectorErr, `{"status":"success","data":{"resultType":"vector","result":[]}}`},
+		{"range vector query", basePath + "/api/v1/query", fmt.Errorf("wrapped: %w", matrixErr),
+			`{"status":"success","data":{"resultType":"matrix","result":[]}}`},
+		{"query api without type", basePath + "/api/v1/query", rewrite.ErrEmptyResult,
+			`{"status":"success","data":{"resultType":"vector","result":[]}}`},
+		{"query range api", basePath + "/api/v1/query_range", vectorErr, `{"status":"success","data":{"resultType":"matrix","result":[]}}`},
+		{"series api", basePath + "/api/v1/series", vectorErr, `{"status":"success","data":[]}`},
+		{"label values api", basePath + "/api/v1/label/cluster/values", rewrite.ErrEmptyResult, `{"status":"success","data":[]}`},
+		{"exemplars api", basePath + "/api/v1/query_exemplars", vectorErr, `{"status":"success","data":[]}`},
+		{"federate api", basePath + "/federate", vectorErr, ""},
+	}
+
+	for _, c := range testCaseList {
+		fakeResp := NewFakeResponse(t)
+		writeEmptyResultResponse(fakeResp, c.apiPath, c.err)
+		if fakeResp.status != http.StatusOK {
+			t.Errorf("case (%v) failed to get expected status: %v", c.name, fakeResp.status)
+		}
+		if string(fakeResp.body) != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, string(fakeResp.body), c.expected)
+		}
+	}
+}
+
+func TestWriteErrorResponse(t *testing.T) {
+	fakeResp := NewFakeResponse(t)
+	writeErrorResponse(fakeResp, http.StatusBadRequest, "bad_data", errors.New("test"))
+	if fakeResp.status != http.StatusBadRequest {
+		t.Errorf("failed to get expected status: %v", fakeResp.status)
+	}
+
+	expected := `{"status":"error","errorType":"bad_data","error":"test"}`
+	if string(fakeResp.body) != expected {
+		t.Errorf("(%v) is not the expected: (%v)", string(fakeResp.body), expected)
+	}
+}
+
 func TestPreCheckRequest(t *testing.T) {
+	defaultAuthenticator := authenticator
+	defer func() { authenticator = defaultAuthenticator }()
+	SetAuthenticator(fakeAuthenticator{"test": {Name: "test"}})
 	req, _ := http.NewRequest("GET", "http://127.0.0.1:3002/metrics/query?query=foo", nil)
 	resp := http.Response{
 		Body:    ioutil.NopCloser(bytes.NewBufferString("test")),
@@ -88,8 +151,8 @@ func TestPreCheckRequest(t *testing.T) {
 	resp.Request.Header.Set("X-Forwarded-Access-Token", "test")
 	resp.Request.Header.Set("X-Forwarded-User", "test")
 	util.InitUserProjectInfo()
-	up := util.NewUserProject("test", "test", []string{"p"})
-	util.UpdateUserProject(up)
+	up := util.NewUserProject("test", []string{"p"})
+	util.UpdateUserProject("test", up)
 	util.InitAllManagedClusterNames()
 	clusters := util.GetAllManagedClusterNames()
 	clusters["p"] = "p"
@@ -105,9 +168,22 @@ func TestPreCheckRequest(t *testing.T) {
 		t.Errorf("failed to test preCheckRequest with bear token: %v", err)
 	}
 
+	// the forwarded user is replaced with the user of the token
+	resp.Request.Header.Set("X-Forwarded-User", "admin")
+	err = preCheckRequest(req)
+	if err != nil || req.Header.Get("X-Forwarded-User") != "test" {
+		t.Errorf("failed to test preCheckRequest with forwarded user: %v, %v", err, req.Header.Get("X-Forwarded-User"))
+	}
+
+	resp.Request.Header.Set("X-Forwarded-Access-Token", "invalid")
+	err = preCheckRequest(req)
+	if err == nil || !strings.Contains(err.Error(), "failed to found user name") {
+		t.Errorf("failed to test preCheckRequest with forwarded user and invalid token: %v", err)
+	}
+
 	resp.Request.Header.Del("X-Forwarded-User")
 	err = preCheckRequest(req)
-	if !strings.Contains(err.Error(), "failed to found user name") {
+	if err == nil || !strings.Contains(err.Error(), "failed to found user name") {
 		t.Errorf("failed to test preCheckRequest: %v", err)
 	}
 
@@ -120,6 +196,259 @@ func TestPreCheckRequest(t *testing.T) {
 
 }
 
+func TestPreCheckRequestWithAccessReview(t *testing.T) {
+	defaultAuthenticator := authenticator
+	defer func() {
+		authenticator = defaultAuthenticator
+		util.SetAccessReviewer(nil)
+	}()
+	SetAuthenticator(fakeAuthenticator{"test": {Name: "test"}})
+	util.SetAccessReviewer(util.NewAccessReviewer(&rest.Config{}, "get", "", time.Minute))
+	util.InitUserProjectInfo()
+	util.InitAllManagedClusterNames()
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:3002/metrics/query?query=foo", nil)
+	req.Header.Set("X-Forwarded-Access-Token", "test")
+	req.Header.Set("X-Forwarded-User", "test")
+	if err := preCheckRequest(req); err == nil || !strings.Contains(err.Error(), "no cluster found") {
+		t.Errorf("failed to test preCheckRequest without cluster: %v", err)
+	}
+
+	util.GetAllManagedClusterNames()["c1"] = "c1"
+	if err := preCheckRequest(req); err != nil {
+		t.Errorf("failed to test preCheckRequest without project: %v", err)
+	}
+}
+
+type fakeAuthenticator map[string]*util.UserInfo
+
+func (a fakeAuthenticator) Authenticate(token string) (*util.UserInfo, error) {
+	if user, ok := a[token]; ok {
+		return user, nil
+	}
+	return nil, errors.New("invalid token")
+}
+
+func TestPreCheckRequestWithGroups(t *testing.T) {
+	defaultAuthenticator := authenticator
+	defer func() {
+		authenticator = defaultAuthenticator
+		util.SetTrustForwardedGroups(false)
+	}()
+	SetAuthenticator(fakeAuthenticator{"test": {Name: "alice", Groups: []string{"team-a"}}})
+	util.InitUserProjectInfo()
+	util.UpdateUserProject("test", util.NewUserProject("alice", []string{"c1"}))
+	util.InitAllManagedClusterNames()
+	util.GetAllManagedClusterNames()["c1"] = "c1"
+
+	testCaseList := []struct {
+		name     string
+		user     string
+		token    string
+		trusted  bool
+		expected string
+		hasError bool
+	}{
+		{"groups of token", "", "test", false, "team-a", false},
+		{"groups of token with forwarded user", "alice", "test", false, "team-a", false},
+		{"trusted forwarded groups", "alice", "test", true, "sre-emea", false},
+		{"failed authentication with forwarded user", "alice", "invalid", false, "", true},
+		{"forwarded user of other token", "bob", "test", false, "team-a", false},
+		{"failed user lookup", "", "invalid", false, "", true},
+	}
+	for _, c := range testCaseList {
+		util.SetTrustForwardedGroups(c.trusted)
+		util.UpdateUserProject(c.token, util.NewUserProject("alice", []string{"c1"}))
+		req, _ := http.NewRequest("GET", "http://127.0.0.1:3002/api/v1/query?query=foo", nil)
+		req.Header.Set("X-Forwarded-Access-Token", c.token)
+		req.Header.Set("X-Forwarded-Groups", "sre-emea")
+		if c.user != "" {
+			req.Header.Set("X-Forwarded-User", c.user)
+		}
+		err := preCheckRequest(req)
+		if (err != nil) != c.hasError {
+			t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, c.hasError)
+		}
+		if err == nil && !c.trusted && req.Header.Get("X-Forwarded-User") != "alice" {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, req.Header.Get("X-Forwarded-User"), "alice")
+		}
+		if err == nil && req.Header.Get("X-Forwarded-Groups") != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, req.Header.Get("X-Forwarded-Groups"), c.expected)
+		}
+	}
+}
+
+func TestPreCheckRequestWithClientCert(t *testing.T) {
+	defer util.InitAllManagedClusterNames()
+	util.InitAllManagedClusterNames()
+	util.GetAllManagedClusterNames()["c1"] = "c1"
+
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "policy.yaml")
+	policy := "rules: [{name: robots, subjects: {groups: [robots]}, clusters: [c1]}]"
+	if err := ioutil.WriteFile(file, []byte(policy), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := util.LoadPolicyFile(file); err != nil {
+		t.Fatalf("failed to load policy file: %v", err)
+	}
+	defer func() {
+		_ = ioutil.WriteFile(file, []byte("rules: []"), 0600)
+		_ = util.LoadPolicyFile(file)
+	}()
+
+	testCaseList := []struct {
+		name     string
+		subject  pkix.Name
+		hasError bool
+	}{
+		{"granted certificate", pkix.Name{CommonName: "robot", Organization: []string{"robots"}}, false},
+		{"certificate without policy", pkix.Name{CommonName: "robot", Organization: []string{"dev"}}, true},
+	}
+	for _, c := range testCaseList {
+		req, _ := http.NewRequest("GET", "https://127.0.0.1:3002/api/v1/query?query=foo", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: c.subject}}}}
+		// the forwarded headers of the client are replaced with the identity of the certificate
+		req.Header.Set("X-Forwarded-User", "admin")
+		req.Header.Set("X-Forwarded-Groups", "system:masters")
+		err := preCheckRequest(req)
+		if (err != nil) != c.hasError {
+			t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, c.hasError)
+		}
+		if req.Header.Get("X-Forwarded-User") != c.subject.CommonName ||
+			req.Header.Get("X-Forwarded-Groups") != strings.Join(c.subject.Organization, ",") {
+			t.Errorf("case (%v) output: (%v, %v) is not the expected: (%v, %v)", c.name,
+				req.Header.Get("X-Forwarded-User"), req.Header.Get("X-Forwarded-Groups"), c.subject.CommonName, c.subject.Organization)
+		}
+	}
+}
+
+func TestPreCheckRequestWithPolicy(t *testing.T) {
+	defaultAuthenticator := authenticator
+	defer func() { authenticator = defaultAuthenticator }()
+	SetAuthenticator(fakeAuthenticator{
+		"robot-token": {Name: "robot"},
+		"alice-token": {Name: "alice"},
+	})
+	util.InitUserProjectInfo()
+	util.InitAllManagedClusterNames()
+	util.GetAllManagedClusterNames()["c1"] = "c1"
+
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(file, []byte("rules: [{name: robots, subjects: {users: [robot]}, clusters: [c1]}]"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := util.LoadPolicyFile(file); err != nil {
+		t.Fatalf("failed to load policy file: %v", err)
+	}
+	defer func() {
+		_ = ioutil.WriteFile(file, []byte("rules: []"), 0600)
+		_ = util.LoadPolicyFile(file)
+	}()
+
+	testCaseList := []struct {
+		name     string
+		user     string
+		token    string
+		hasError bool
+	}{
+		{"granted user", "", "robot-token", false},
+		{"granted user forwarded with other token", "robot", "alice-token", true},
+	}
+	for _, c := range testCaseList {
+		// the users have no project, so they can only access the clusters granted by the policy
+		util.UpdateUserProject(c.token, util.NewUserProject("", []string{}))
+		req, _ := http.NewRequest("GET", "http://127.0.0.1:3002/api/v1/query?query=foo", nil)
+		req.Header.Set("X-Forwarded-Access-Token", c.token)
+		if c.user != "" {
+			req.Header.Set("X-Forwarded-User", c.user)
+		}
+		err := preCheckRequest(req)
+		if (err != nil) != c.hasError {
+			t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, c.hasError)
+		}
+	}
+}
+
+func TestPreCheckRequestWithImpersonation(t *testing.T) {
+	defaultAuthenticator := authenticator
+	defer func() {
+		authenticator = defaultAuthenticator
+		util.SetImpersonationReviewer(nil)
+	}()
+	SetAuthenticator(fakeAuthenticator{"admin": {Name: "admin", Groups: []string{"sre"}}})
+	util.InitUserProjectInfo()
+	util.InitAllManagedClusterNames()
+	util.GetAllManagedClusterNames()["c1"] = "c1"
+
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:3002/api/v1/query?query=foo", nil)
+	req.Header.Set("X-Forwarded-Access-Token", "admin")
+	req.Header.Set("Impersonate-User", "alice")
+	req.Header.Set("Impersonate-Group", "team-a")
+	if err := preCheckRequest(req); err == nil || !strings.Contains(err.Error(), "impersonation is not enabled") {
+		t.Errorf("failed to test preCheckRequest with disabled impersonation: %v", err)
+	}
+
+	// the reviews are sent to an unreachable api server, so that the impersonation cannot be authorized
+	util.SetImpersonationReviewer(util.NewAccessReviewer(&rest.Config{Host: "http://127.0.0.1:1"}, "get", "", time.Minute))
+	if err := preCheckRequest(req); err == nil || req.Header.Get("X-Forwarded-User") == "alice" {
+		t.Errorf("failed to test preCheckRequest with unauthorized impersonation: %v", err)
+	}
+}
+
+func TestPreCheckRequestWithImpersonationWithoutGroups(t *testing.T) {
+	defaultAuthenticator := authenticator
+	defer func() {
+		authenticator = defaultAuthenticator
+		util.SetImpersonationReviewer(nil)
+	}()
+	// the access reviews of the admin are allowed
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		review := map[string]interface{}{}
+		_ = json.NewDecoder(r.Body).Decode(&review)
+		review["status"] = map[string]interface{}{"allowed": true}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(review)
+	}))
+	defer server.Close()
+	util.SetImpersonationReviewer(util.NewAccessReviewer(&rest.Config{Host: server.URL}, "get", "", time.Minute))
+	// the groups of the impersonated user are not resolved without the OpenShift authenticator,
+	// so that the impersonated user only has the groups of the Impersonate-Group headers
+	SetImpersonatedGroupsResolution(false)
+	SetAuthenticator(fakeAuthenticator{"admin": {Name: "admin", Groups: []string{"sre"}}})
+	util.InitUserProjectInfo()
+	util.InitAllManagedClusterNames()
+	util.GetAllManagedClusterNames()["c1"] = "c1"
+
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:3002/api/v1/query?query=foo", nil)
+	req.Header.Set("X-Forwarded-Access-Token", "admin")
+	req.Header.Set("Impersonate-User", "alice")
+	if err := preCheckRequest(req); err != nil {
+		t.Errorf("failed to test preCheckRequest with impersonation without groups: %v", err)
+	}
+	if req.Header.Get("X-Forwarded-User") != "alice" || len(req.Header.Values("Impersonate-Group")) != 0 {
+		t.Errorf("case (impersonation without groups) output: (%v) is not the expected: (alice without groups)", req.Header)
+	}
+}
+
+func TestProxyRequestRemovesImpersonation(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:3002/api/v1/labels", nil)
+	req.Header.Set("Impersonate-User", "alice")
+	req.Header.Set("Impersonate-Group", "team-a")
+	proxyRequest(req)
+	if req.Header.Get("Impersonate-User") != "" || req.Header.Get("Impersonate-Group") != "" {
+		t.Errorf("impersonation headers are sent to upstream: %v", req.Header)
+	}
+}
+
 func TestGzipWrite(t *testing.T) {
 	originalStr := "test"
 	var compressedBuff bytes.Buffer
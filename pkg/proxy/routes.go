@@ -0,0 +1,106 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package proxy
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+
+	"k8s.io/klog"
+)
+
+// routeStrategy is how the requests to a prometheus API are handled
+type routeStrategy string
+
+const (
+	// rewriteStrategy rewrites the queries with the accessible clusters and filters the result series
+	rewriteStrategy routeStrategy = "rewrite"
+	// postFilterStrategy filters the response with the accessible clusters
+	postFilterStrategy routeStrategy = "post-filter"
+	// adminOnlyStrategy only allows the users who can access all clusters
+	adminOnlyStrategy routeStrategy = "admin-only"
+	// passthroughStrategy sends the requests to upstream as is
+	passthroughStrategy routeStrategy = "passthrough"
+)
+
+// route maps the path pattern of a prometheus API to the handling strategy,
+// the pattern is matched with the request path by path.Match
+type route struct {
+	pattern  string
+	strategy routeStrategy
+}
+
+// defaultRoutes are the supported prometheus APIs, the requests
+// to the APIs not found in the routes are denied
+var defaultRoutes = []route{
+	{"/api/v1/query", rewriteStrategy},
+	{"/api/v1/query_range", rewriteStrategy},
+	{"/api/v1/series", rewriteStrategy},
+	{"/api/v1/labels", rewriteStrategy},
+	{"/api/v1/label/*/values", rewriteStrategy},
+	{"/api/v1/read", rewriteStrategy},
+	{"/federate", rewriteStrategy},
+	{"/api/v1/query_exemplars", rewriteStrategy},
+	{"/api/v1/rules", postFilterStrategy},
+	{"/api/v1/alerts", postFilterStrategy},
+	{"/api/v1/targets/metadata", postFilterStrategy},
+	{"/api/v1/metadata", passthroughStrategy},
+	{"/api/v1/status/buildinfo", passthroughStrategy},
+	{"/api/v1/status/*", adminOnlyStrategy},
+}
+
+var routes = defaultRoutes
+var routesMutex sync.RWMutex
+
+// AddRoutes extends the routes with the strategies of the path patterns, they take precedence over
+// the default routes. The longer patterns are matched first, so that the overlapping patterns have
+// the same precedence on every start, e.g. /api/v1/custom/a before /api/v1/custom/*
+func AddRoutes(extraRoutes map[string]string) error {
+	patterns := make([]string, 0, len(extraRoutes))
+	for pattern := range extraRoutes {
+		patterns = append(patterns, pattern)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+
+	newRoutes := []route{}
+	for _, pattern := range patterns {
+		strategy := extraRoutes[pattern]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid route pattern %q: %v", pattern, err)
+		}
+		switch routeStrategy(strategy) {
+		case rewriteStrategy, postFilterStrategy, adminOnlyStrategy, passthroughStrategy:
+		default:
+			return fmt.Errorf("invalid strategy %q for route %q", strategy, pattern)
+		}
+		klog.Infof("added route %s with strategy %s", pattern, strategy)
+		newRoutes = append(newRoutes, route{pattern, routeStrategy(strategy)})
+	}
+
+	routesMutex.Lock()
+	routes = append(newRoutes, routes...)
+	routesMutex.Unlock()
+	return nil
+}
+
+// findRouteStrategy returns the strategy of the first route matching the api path,
+// false is returned when no route is found
+func findRouteStrategy(apiPath string) (routeStrategy, bool) {
+	apiPath = path.Clean("/" + apiPath)
+	routesMutex.RLock()
+	defer routesMutex.RUnlock()
+	for _, r := range routes {
+		if matched, _ := path.Match(r.pattern, apiPath); matched {
+			return r.strategy, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stolostron/rbac-query-proxy/pkg/util"
+)
+
+func TestFindRouteStrategy(t *testing.T) {
+	testCaseList := []struct {
+		name     string
+		apiPath  string
+		expected routeStrategy
+		found    bool
+	}{
+		{"query api", "/api/v1/query", rewriteStrategy, true},
+		{"label values api", "/api/v1/label/cluster/values", rewriteStrategy, true},
+		{"rules api", "/api/v1/rules", postFilterStrategy, true},
+		{"targets metadata api", "/api/v1/targets/metadata", postFilterStrategy, true},
+		{"metadata api", "/api/v1/metadata", passthroughStrategy, true},
+		{"build info api", "/api/v1/status/buildinfo", passthroughStrategy, true},
+		{"status api", "/api/v1/status/config", adminOnlyStrategy, true},
+		{"unclean path", "/api/v1/../v1//query", rewriteStrategy, true},
+		{"tsdb admin api", "/api/v1/admin/tsdb/delete_series", "", false},
+		{"unknown api", "/api/v2/query", "", false},
+		{"root path", "/", "", false},
+	}
+
+	for _, c := range testCaseList {
+		output, found := findRouteStrategy(c.apiPath)
+		if output != c.expected || found != c.found {
+			t.Errorf("case (%v) output: (%v, %v) is not the expected: (%v, %v)", c.name, output, found, c.expected, c.found)
+		}
+	}
+}
+
+func TestAddRoutes(t *testing.T) {
+	defer func() {
+		routes = defaultRoutes
+	}()
+
+	err := AddRoutes(map[string]string{
+		"/api/v1/status/config": "passthrough",
+		"/api/v1/custom/*":      "admin-only",
+	})
+	if err != nil {
+		t.Errorf("failed to add routes: %v", err)
+	}
+
+	testCaseList := []struct {
+		name     string
+		apiPath  string
+		expected routeStrategy
+	}{
+		{"overridden route", "/api/v1/status/config", passthroughStrategy},
+		{"new route", "/api/v1/custom/a", adminOnlyStrategy},
+		{"default route", "/api/v1/status/flags", adminOnlyStrategy},
+	}
+	for _, c := range testCaseList {
+		output, _ := findRouteStrategy(c.apiPath)
+		if output != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+	}
+
+	// the overlapping patterns are matched from the longest one
+	for i := 0; i < 10; i++ {
+		routes = defaultRoutes
+		err := AddRoutes(map[string]string{
+			"/api/v1/custom/*":      "admin-only",
+			"/api/v1/custom/a*":     "passthrough",
+			"/api/v1/custom/public": "rewrite",
+		})
+		if err != nil {
+			t.Errorf("failed to add routes: %v", err)
+		}
+		for apiPath, expected := range map[string]routeStrategy{
+			"/api/v1/custom/b":      adminOnlyStrategy,
+			"/api/v1/custom/a":      passthroughStrategy,
+			"/api/v1/custom/public": rewriteStrategy,
+		} {
+			if output, _ := findRouteStrategy(apiPath); output != expected {
+				t.Errorf("case (overlapping route %v) output: (%v) is not the expected: (%v)", apiPath, output, expected)
+			}
+		}
+	}
+
+	if err := AddRoutes(map[string]string{"/api/v1/query": "unknown"}); err == nil {
+		t.Errorf("case (invalid strategy) should return error")
+	}
+	if err := AddRoutes(map[string]string{"/api/v1/[": "rewrite"}); err == nil {
+		t.Errorf("case (invalid pattern) should return error")
+	}
+}
+
+func TestHandleRequestAndRedirectWithUnknownAPI(t *testing.T) {
+	defaultAuthenticator := authenticator
+	defer func() { authenticator = defaultAuthenticator }()
+	SetAuthenticator(fakeAuthenticator{"test": {Name: "test"}})
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:3002/api/v1/admin/tsdb/snapshot", nil)
+	req.Header.Set("X-Forwarded-Access-Token", "test")
+	req.Header.Set("X-Forwarded-User", "test")
+	util.InitUserProjectInfo()
+	util.UpdateUserProject("test", util.NewUserProject("test", []string{"p"}))
+	util.InitAllManagedClusterNames()
+	util.GetAllManagedClusterNames()["p"] = "p"
+	fakeResp := NewFakeResponse(t)
+	HandleRequestAndRedirect(fakeResp, req)
+	if fakeResp.status != http.StatusForbidden {
+		t.Errorf("failed to get expected status: %v", fakeResp.status)
+	}
+}
@@ -6,6 +6,7 @@ package proxy
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -59,3 +60,27 @@ func getTLSTransport() (*http.Transport, error) {
 		TLSClientConfig:       tlsConfig,
 	}, nil
 }
+
+// NewServerTLSConfig returns the tls config of the proxy server, the client certificates are verified with
+// the CA bundle of the clientCAFile when it is set. The requests without client certificate are still
+// accepted, since they are authenticated with the bearer tokens
+func NewServerTLSConfig(clientCAFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	caCert, err := ioutil.ReadFile(filepath.Clean(clientCAFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client ca file: %v", err)
+	}
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificate found in client ca file: %s", clientCAFile)
+	}
+	tlsConfig.ClientCAs = caCertPool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConfig, nil
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newCAPEM(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client-ca")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, newCAPEM(t), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	invalidFile := filepath.Join(dir, "invalid.crt")
+	if err := ioutil.WriteFile(invalidFile, []byte("invalid"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	testCaseList := []struct {
+		name       string
+		file       string
+		clientAuth tls.ClientAuthType
+		hasError   bool
+	}{
+		{"no client ca", "", tls.NoClientCert, false},
+		{"client ca", caFile, tls.VerifyClientCertIfGiven, false},
+		{"invalid client ca", invalidFile, tls.NoClientCert, true},
+		{"missing client ca", filepath.Join(dir, "missing.crt"), tls.NoClientCert, true},
+	}
+
+	for _, c := range testCaseList {
+		tlsConfig, err := NewServerTLSConfig(c.file)
+		if (err != nil) != c.hasError {
+			t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, c.hasError)
+		}
+		if err == nil && tlsConfig.ClientAuth != c.clientAuth {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, tlsConfig.ClientAuth, c.clientAuth)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/stolostron/rbac-query-proxy/pkg/util"
+)
+
+const clusterValuesAPIPath = "/api/v1/label/cluster/values"
+
+// labelValuesResponse is the prometheus API response of the label values
+type labelValuesResponse struct {
+	Status string   `json:"status"`
+	Data   []string `json:"data"`
+}
+
+// WatchUpstreamClusterNames loads the values of the cluster label stored upstream every interval, the
+// negative cluster filter is only used once they are loaded, so that it excludes the metrics of the
+// clusters deleted before the proxy started
+func WatchUpstreamClusterNames(interval time.Duration) {
+	for {
+		if err := loadUpstreamClusterNames(); err != nil {
+			klog.Errorf("failed to load the clusters stored upstream: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func loadUpstreamClusterNames() error {
+	tlsTransport, err := getTLSTransport()
+	if err != nil {
+		return err
+	}
+	names, err := fetchUpstreamClusterNames(&http.Client{Transport: tlsTransport}, os.Getenv("METRICS_SERVER"))
+	if err != nil {
+		return err
+	}
+	klog.V(1).Infof("loaded %v clusters stored upstream", len(names))
+	util.SetUpstreamClusterNames(names)
+	return nil
+}
+
+// fetchUpstreamClusterNames returns the values of the cluster label from the label values API of upstream
+func fetchUpstreamClusterNames(client *http.Client, serverURL string) ([]string, error) {
+	resp, err := client.Get(strings.TrimSuffix(serverURL, "/") + path.Join(basePath, clusterValuesAPIPath))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status of cluster label values: %v", resp.Status)
+	}
+
+	values := labelValuesResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&values); err != nil {
+		return nil, fmt.Errorf("failed to decode cluster label values: %v", err)
+	}
+	if values.Status != "success" {
+		return nil, fmt.Errorf("unexpected status of cluster label values: %v", values.Status)
+	}
+	return values.Data, nil
+}
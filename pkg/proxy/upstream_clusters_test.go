@@ -0,0 +1,48 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestFetchUpstreamClusterNames(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case basePath + clusterValuesAPIPath:
+			_, _ = w.Write([]byte(`{"status":"success","data":["c0","c1","deleted"]}`))
+		case "/error" + basePath + clusterValuesAPIPath:
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"internal","error":"failed"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	testCaseList := []struct {
+		name     string
+		url      string
+		expected []string
+		hasError bool
+	}{
+		{"cluster values", server.URL, []string{"c0", "c1", "deleted"}, false},
+		{"cluster values with trailing slash", server.URL + "/", []string{"c0", "c1", "deleted"}, false},
+		{"error response", server.URL + "/error", nil, true},
+		{"not found", server.URL + "/missing", nil, true},
+		{"unreachable upstream", "http://127.0.0.1:1", nil, true},
+	}
+
+	for _, c := range testCaseList {
+		output, err := fetchUpstreamClusterNames(http.DefaultClient, c.url)
+		if (err != nil) != c.hasError {
+			t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, c.hasError)
+		}
+		if !reflect.DeepEqual(output, c.expected) {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+	}
+}
@@ -4,49 +4,622 @@
 package rewrite
 
 import (
+	"errors"
+	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 
-	"github.com/openshift/prom-label-proxy/injectproxy"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 	"k8s.io/klog"
 )
 
-const (
-	placeholderMetrics = "acm_metrics_placeholder"
-)
+// ErrEmptyResult is returned when none of the allowed values matches the existing
+// label filters of the query, so the query cannot return any series
+var ErrEmptyResult = errors.New("no allowed label value matches the query")
+
+// EmptyResultError is the ErrEmptyResult of a query, the value type is the type of the empty result,
+// e.g. the empty matrix of a range vector query
+type EmptyResultError struct {
+	ValueType parser.ValueType
+}
+
+func (e *EmptyResultError) Error() string {
+	return ErrEmptyResult.Error()
+}
+
+func (e *EmptyResultError) Unwrap() error {
+	return ErrEmptyResult
+}
+
+// ErrAmbiguousScope is returned when the query selects the label values with different allowed scoped
+// values, so that they cannot be expressed with independent label filters
+var ErrAmbiguousScope = errors.New("query spans different label scopes")
 
-// InjectLabels is used to inject addtional label filters into original query
+const regexMetaChars = `\.+*?()|[]{}^$`
+
+// enforcedMatcher is a label filter to inject, the values are set when the
+// matcher only matches a finite set of values
+type enforcedMatcher struct {
+	matcher *labels.Matcher
+	values  []string
+	finite  bool
+	// allValues are all the possible values of the label, they are used to express
+	// the label filter as the negative regex of the values which are not allowed
+	allValues []string
+}
+
+// InjectLabels is used to inject addtional label filters into original query,
+// the existing filters for the label are intersected with the allowed values
 func InjectLabels(query string, label string, values []string) (string, error) {
+	return injectMatchers(query, []enforcedMatcher{
+		{
+			matcher: &labels.Matcher{Name: label},
+			values:  values,
+			finite:  true,
+		},
+	})
+}
 
-	reg := regexp.MustCompile(`([{|,][ ]*)(` + label + `[ ]*)(=|!=|=~|!~)([ ]*"[^"]+")`)
-	query = reg.ReplaceAllString(query, "$1 "+placeholderMetrics+" $3$4")
+// InjectLabelsWithExclusion is like InjectLabels, but the label filter is expressed as the negative regex
+// of the values in allValues which are not allowed, when it is shorter than the regex of the allowed values.
+// The negative regex is added to the existing filters for the label, and the two are only equivalent
+// when allValues contains all the possible values of the label
+func InjectLabelsWithExclusion(query string, label string, values []string, allValues []string) (string, error) {
+	return injectMatchers(query, []enforcedMatcher{
+		{
+			matcher:   &labels.Matcher{Name: label},
+			values:    values,
+			finite:    true,
+			allValues: allValues,
+		},
+	})
+}
+
+// InjectMatchers is used to inject the label matchers into every selector of the original query.
+// The matchers which only match a finite set of values (= and the regex alternation of literals)
+// are intersected with the existing filters for the same label, the other matchers are added
+// to the existing filters
+func InjectMatchers(query string, matchers []*labels.Matcher) (string, error) {
+	enforcedMatchers := make([]enforcedMatcher, len(matchers))
+	for idx, m := range matchers {
+		values, finite := literalValues(m)
+		enforcedMatchers[idx] = enforcedMatcher{
+			matcher: m,
+			values:  values,
+			finite:  finite,
+		}
+	}
+	return injectMatchers(query, enforcedMatchers)
+}
+
+func injectMatchers(query string, matchers []enforcedMatcher) (string, error) {
+	return rewriteSelectors(query, func(vs *parser.VectorSelector) (bool, error) {
+		empty := false
+		for _, em := range matchers {
+			if !em.finite && em.matcher.Name == labels.MetricName && vs.Name != "" {
+				// the metric name cannot be set twice, so the matcher is intersected with the name
+				nameValues := intersectValues([]*labels.Matcher{em.matcher}, labels.MetricName, []string{vs.Name})
+				allowedValues, err := replaceValuesMatchers(vs, labels.MetricName, nameValues, nil)
+				if err != nil {
+					return false, err
+				}
+				if len(allowedValues) == 0 {
+					empty = true
+				}
+				continue
+			}
+			if !em.finite {
+				vs.LabelMatchers = appendLabelMatcher(vs.LabelMatchers, em.matcher)
+				continue
+			}
 
+			allowedValues, err := replaceValuesMatchers(vs, em.matcher.Name, em.values, em.allValues)
+			if err != nil {
+				return false, err
+			}
+			if len(allowedValues) == 0 {
+				empty = true
+			}
+		}
+		return empty, nil
+	})
+}
+
+// InjectScopedLabels is used to inject the filters for the label and the scoped label into original query.
+// The scope maps the allowed values of the label to the allowed values of the scoped label, e.g. the
+// namespaces for each cluster, the scoped label of the values mapped to nil is not restricted. Both labels
+// are intersected with the existing filters. When the remaining
+// values of the label are mapped to different scoped values, the selector is replaced with the disjunction
+// of a selector for each scope, e.g. (up{cluster="A",namespace="ns1"} or up{cluster="B",namespace="ns2"}).
+// ErrAmbiguousScope is returned when the selector of a range vector cannot be split, e.g. absent_over_time(up[5m])
+func InjectScopedLabels(query string, label string, scopedLabel string, scope map[string][]string) (string, error) {
+	s := newScopeSplitter(label, scopedLabel, scope)
 	expr, err := parser.ParseExpr(query)
 	if err != nil {
 		klog.Errorf("Failed to parse the query %s: %v", query, err)
 		return "", err
 	}
+	expr, err = s.split(expr)
+	if err != nil {
+		klog.Errorf("Failed to split the query %s: %v", query, err)
+		return "", err
+	}
+	return s.inject(expr.String())
+}
+
+// InjectScopedLabelsSelectors is like InjectScopedLabels for the selectors which cannot be replaced with
+// the disjunction, e.g. the match[] selectors, a selector is returned for each scope instead
+func InjectScopedLabelsSelectors(selector string, label string, scopedLabel string, scope map[string][]string) ([]string, error) {
+	s := newScopeSplitter(label, scopedLabel, scope)
+	expr, err := parser.ParseExpr(selector)
+	if err != nil {
+		klog.Errorf("Failed to parse the selector %s: %v", selector, err)
+		return nil, err
+	}
+	vs, ok := expr.(*parser.VectorSelector)
+	if !ok || len(s.groups(vs)) < 2 {
+		query, err := InjectScopedLabels(selector, label, scopedLabel, scope)
+		return []string{query}, err
+	}
 
-	matchType := labels.MatchRegexp
-	if len(values) == 1 {
-		matchType = labels.MatchEqual
+	selectors := []string{}
+	for _, group := range s.groups(vs) {
+		scopedExpr, err := s.restrict(vs, group, func(e parser.Expr) (*parser.VectorSelector, bool) {
+			vs, ok := e.(*parser.VectorSelector)
+			return vs, ok
+		})
+		if err != nil {
+			return nil, err
+		}
+		query, err := s.inject(scopedExpr.String())
+		if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, query)
 	}
-	err = injectproxy.SetRecursive(expr, []*labels.Matcher{
-		{
-			Name:  label,
-			Type:  matchType,
-			Value: strings.Join(values[:], "|"),
-		},
+	return selectors, nil
+}
+
+// scopeSplitter splits the selectors of the values with different scoped values
+type scopeSplitter struct {
+	label       string
+	scopedLabel string
+	values      []string
+	scope       map[string][]string
+}
+
+func newScopeSplitter(label string, scopedLabel string, scope map[string][]string) *scopeSplitter {
+	values := make([]string, 0, len(scope))
+	for v := range scope {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return &scopeSplitter{label: label, scopedLabel: scopedLabel, values: values, scope: scope}
+}
+
+// groups returns the values of the label which match the existing filters of the selector, grouped by
+// the allowed scoped values. The values without any scoped value matching the existing filters are dropped
+func (s *scopeSplitter) groups(vs *parser.VectorSelector) [][]string {
+	groups := [][]string{}
+	groupScopedValues := [][]string{}
+	for _, v := range intersectValues(vs.LabelMatchers, s.label, s.values) {
+		allowedScopedValues := s.scopedValues(vs, v)
+		if allowedScopedValues != nil && len(allowedScopedValues) == 0 {
+			continue
+		}
+		grouped := false
+		for idx := range groups {
+			if (groupScopedValues[idx] == nil) == (allowedScopedValues == nil) &&
+				sameValues(groupScopedValues[idx], allowedScopedValues) {
+				groups[idx] = append(groups[idx], v)
+				grouped = true
+				break
+			}
+		}
+		if !grouped {
+			groups = append(groups, []string{v})
+			groupScopedValues = append(groupScopedValues, allowedScopedValues)
+		}
+	}
+	return groups
+}
+
+// scopedValues returns the scoped values of the value which match the existing filters of the selector,
+// nil is returned when the scoped label of the value is not restricted
+func (s *scopeSplitter) scopedValues(vs *parser.VectorSelector, value string) []string {
+	if s.scope[value] == nil {
+		return nil
+	}
+	return intersectValues(vs.LabelMatchers, s.scopedLabel, s.scope[value])
+}
+
+// split replaces the selectors of the values with different scoped values with the disjunction of a
+// selector for each scope. The functions of the range vectors are applied to each series on their own,
+// so they are replaced with the disjunction of the functions of the range vector of each scope instead
+func (s *scopeSplitter) split(expr parser.Expr) (parser.Expr, error) {
+	var err error
+	switch n := expr.(type) {
+	case *parser.VectorSelector:
+		if len(s.groups(n)) > 1 {
+			return s.disjunction(n, s.groups(n), func(e parser.Expr) (*parser.VectorSelector, bool) {
+				vs, ok := e.(*parser.VectorSelector)
+				return vs, ok
+			})
+		}
+	case *parser.MatrixSelector:
+		vs, ok := n.VectorSelector.(*parser.VectorSelector)
+		if ok && len(s.groups(vs)) > 1 {
+			return nil, fmt.Errorf("%w: %s %v have different allowed %s in range vector %s",
+				ErrAmbiguousScope, s.label, s.groups(vs), s.scopedLabel, n)
+		}
+	case *parser.Call:
+		for idx, arg := range n.Args {
+			ms, ok := arg.(*parser.MatrixSelector)
+			if !ok || n.Func.Name == "absent_over_time" {
+				if n.Args[idx], err = s.split(arg); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			vs, ok := ms.VectorSelector.(*parser.VectorSelector)
+			if ok && len(s.groups(vs)) > 1 {
+				argIdx := idx
+				return s.disjunction(n, s.groups(vs), func(e parser.Expr) (*parser.VectorSelector, bool) {
+					call, ok := e.(*parser.Call)
+					if !ok {
+						return nil, false
+					}
+					ms, ok := call.Args[argIdx].(*parser.MatrixSelector)
+					if !ok {
+						return nil, false
+					}
+					vs, ok := ms.VectorSelector.(*parser.VectorSelector)
+					return vs, ok
+				})
+			}
+		}
+	case *parser.AggregateExpr:
+		if n.Param != nil {
+			if n.Param, err = s.split(n.Param); err != nil {
+				return nil, err
+			}
+		}
+		n.Expr, err = s.split(n.Expr)
+	case *parser.BinaryExpr:
+		if n.LHS, err = s.split(n.LHS); err != nil {
+			return nil, err
+		}
+		n.RHS, err = s.split(n.RHS)
+	case *parser.ParenExpr:
+		n.Expr, err = s.split(n.Expr)
+	case *parser.UnaryExpr:
+		n.Expr, err = s.split(n.Expr)
+	case *parser.SubqueryExpr:
+		n.Expr, err = s.split(n.Expr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+// disjunction returns the disjunction of a copy of the expression for each group, the selector of each
+// copy only selects the values of the group. The series of the copies have different values of the label,
+// so the disjunction returns the series of every copy
+func (s *scopeSplitter) disjunction(expr parser.Expr, groups [][]string,
+	selector func(parser.Expr) (*parser.VectorSelector, bool)) (parser.Expr, error) {
+	var disjunction parser.Expr
+	for _, group := range groups {
+		scopedExpr, err := s.restrict(expr, group, selector)
+		if err != nil {
+			return nil, err
+		}
+		// the other arguments of the functions may be split as well
+		if scopedExpr, err = s.split(scopedExpr); err != nil {
+			return nil, err
+		}
+		if disjunction == nil {
+			disjunction = scopedExpr
+			continue
+		}
+		disjunction = &parser.BinaryExpr{
+			Op:             parser.LOR,
+			LHS:            disjunction,
+			RHS:            scopedExpr,
+			VectorMatching: &parser.VectorMatching{Card: parser.CardManyToMany},
+		}
+	}
+	return &parser.ParenExpr{Expr: disjunction}, nil
+}
+
+// restrict returns a copy of the expression, the selector of the copy only selects the values of the group
+func (s *scopeSplitter) restrict(expr parser.Expr, group []string,
+	selector func(parser.Expr) (*parser.VectorSelector, bool)) (parser.Expr, error) {
+	scopedExpr, err := parser.ParseExpr(expr.String())
+	if err != nil {
+		return nil, err
+	}
+	vs, ok := selector(scopedExpr)
+	if !ok {
+		return nil, fmt.Errorf("failed to find the selector in %s", scopedExpr)
+	}
+	if _, err := replaceValuesMatchers(vs, s.label, group, nil); err != nil {
+		return nil, err
+	}
+	return scopedExpr, nil
+}
+
+// inject injects the filters of the label and the scoped label into the selectors of the query,
+// ErrAmbiguousScope is returned when any selector is not split by the scopes
+func (s *scopeSplitter) inject(query string) (string, error) {
+	return rewriteSelectors(query, func(vs *parser.VectorSelector) (bool, error) {
+		allowedValues := []string{}
+		scopedValues := []string{}
+		groups := s.groups(vs)
+		if len(groups) > 1 {
+			return false, fmt.Errorf("%w: %s %v have different allowed %s",
+				ErrAmbiguousScope, s.label, groups, s.scopedLabel)
+		}
+		if len(groups) == 1 {
+			allowedValues = groups[0]
+			scopedValues = s.scopedValues(vs, allowedValues[0])
+		}
+
+		allowedValues, err := replaceValuesMatchers(vs, s.label, allowedValues, nil)
+		if err != nil {
+			return false, err
+		}
+		if scopedValues == nil {
+			// the existing filters of the scoped label are kept
+			return len(allowedValues) == 0, nil
+		}
+		allowedScopedValues, err := replaceValuesMatchers(vs, s.scopedLabel, scopedValues, nil)
+		if err != nil {
+			return false, err
+		}
+		return len(allowedValues) == 0 || len(allowedScopedValues) == 0, nil
+	})
+}
+
+// rewriteSelectors calls rewriteFunc for every selector of the query, rewriteFunc returns true
+// when the selector cannot match any series after rewriting. ErrEmptyResult is returned as the
+// EmptyResultError of the query type when none of the selectors matches any series and the query
+// cannot return any result then
+func rewriteSelectors(query string, rewriteFunc func(vs *parser.VectorSelector) (bool, error)) (string, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		klog.Errorf("Failed to parse the query %s: %v", query, err)
+		return "", err
+	}
+
+	selectorCount, emptySelectorCount := 0, 0
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok || err != nil {
+			return nil
+		}
+
+		selectorCount++
+		var empty bool
+		empty, err = rewriteFunc(vs)
+		if empty {
+			emptySelectorCount++
+		}
+		return nil
 	})
 	if err != nil {
 		klog.Errorf("Failed to inject the label filters: %v", err)
 		return "", err
 	}
 
-	query = strings.Replace(expr.String(), placeholderMetrics, label, -1)
-	klog.Infof("Query string after filter inject: %s", query)
+	if selectorCount > 0 && selectorCount == emptySelectorCount && !mayReturnWithoutSeries(expr) {
+		klog.Infof("Query %s does not match any allowed label value", query)
+		return "", &EmptyResultError{ValueType: expr.Type()}
+	}
+
+	query = expr.String()
+	klog.V(1).Infof("Query string after filter inject: %s", query)
 
 	return query, nil
 }
+
+// mayReturnWithoutSeries checks whether the query can return a result when none of its selectors matches
+// any series, e.g. count(x) or vector(0) and absent(x), so that the empty result cannot be returned
+// without sending the query. The queries with scalar results are never empty
+func mayReturnWithoutSeries(expr parser.Expr) bool {
+	if _, ok := expr.(*parser.VectorSelector); ok {
+		return false
+	}
+	if expr.Type() != parser.ValueTypeVector && expr.Type() != parser.ValueTypeMatrix {
+		return true
+	}
+
+	found := false
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.Call:
+			if n.Func.Name == "vector" || strings.HasPrefix(n.Func.Name, "absent") {
+				found = true
+			}
+		case *parser.BinaryExpr:
+			if n.Op == parser.LOR {
+				found = true
+			}
+		}
+		return nil
+	})
+	return found
+}
+
+// replaceValuesMatchers replaces the existing filters for the label with a single matcher for the
+// values which match all the existing filters, the remaining values are returned. When the negative
+// regex of the values in allValues which are not allowed is shorter, it is added to the existing
+// filters instead. The name of the selector is replaced with the matcher of the metric name, so
+// that the name is not set twice
+func replaceValuesMatchers(vs *parser.VectorSelector, label string, values []string, allValues []string) ([]string, error) {
+	allowedValues := intersectValues(vs.LabelMatchers, label, values)
+	matcher, err := newValuesMatcher(label, allowedValues)
+	if err != nil {
+		return nil, err
+	}
+
+	if allValues != nil && len(allowedValues) > 0 {
+		exclusionMatcher, err := newExclusionMatcher(label, values, allValues)
+		if err != nil {
+			return nil, err
+		}
+		if len(exclusionMatcher.Value) < len(matcher.Value) {
+			// the exclusion only excludes the values which are not allowed, the existing filters still apply
+			vs.LabelMatchers = append(vs.LabelMatchers, exclusionMatcher)
+			return allowedValues, nil
+		}
+	}
+
+	vs.LabelMatchers = append(removeLabelMatchers(vs.LabelMatchers, label), matcher)
+	if label == labels.MetricName {
+		vs.Name = ""
+		if matcher.Type == labels.MatchEqual {
+			vs.Name = matcher.Value
+		}
+	}
+	return allowedValues, nil
+}
+
+func sameValues(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sortedA := append([]string{}, a...)
+	sortedB := append([]string{}, b...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+	for idx := range sortedA {
+		if sortedA[idx] != sortedB[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// literalValues returns the values matched by the matcher if it only matches a finite set of values
+func literalValues(m *labels.Matcher) ([]string, bool) {
+	switch m.Type {
+	case labels.MatchEqual:
+		return []string{m.Value}, true
+	case labels.MatchRegexp:
+		values := []string{}
+		var value strings.Builder
+		escaped := false
+		for _, r := range m.Value {
+			switch {
+			case escaped:
+				if !strings.ContainsRune(regexMetaChars, r) {
+					// escape sequences like \d are not literals
+					return nil, false
+				}
+				value.WriteRune(r)
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == '|':
+				values = append(values, value.String())
+				value.Reset()
+			case strings.ContainsRune(regexMetaChars, r):
+				return nil, false
+			default:
+				value.WriteRune(r)
+			}
+		}
+		if escaped {
+			return nil, false
+		}
+		return append(values, value.String()), true
+	default:
+		return nil, false
+	}
+}
+
+func appendLabelMatcher(matchers []*labels.Matcher, matcher *labels.Matcher) []*labels.Matcher {
+	for _, m := range matchers {
+		if m.Name == matcher.Name && m.Type == matcher.Type && m.Value == matcher.Value {
+			return matchers
+		}
+	}
+	return append(matchers, matcher)
+}
+
+// intersectValues returns the distinct values which match all the existing filters for the label
+func intersectValues(matchers []*labels.Matcher, label string, values []string) []string {
+	allowedValues := []string{}
+	seen := map[string]bool{}
+	for _, v := range values {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		matched := true
+		for _, m := range matchers {
+			if m.Name == label && !m.Matches(v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			allowedValues = append(allowedValues, v)
+		}
+	}
+	return allowedValues
+}
+
+func removeLabelMatchers(matchers []*labels.Matcher, label string) []*labels.Matcher {
+	res := []*labels.Matcher{}
+	for _, m := range matchers {
+		if m.Name != label {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// newValuesMatcher returns the matcher for the values, a matcher which matches nothing
+// is returned when there is no value
+func newValuesMatcher(label string, values []string) (*labels.Matcher, error) {
+	if len(values) == 0 {
+		return labels.NewMatcher(labels.MatchNotRegexp, label, ".*")
+	}
+	if len(values) == 1 {
+		return labels.NewMatcher(labels.MatchEqual, label, values[0])
+	}
+	return labels.NewMatcher(labels.MatchRegexp, label, joinQuotedValues(values))
+}
+
+// newExclusionMatcher returns the negative regex of the values in allValues which are not in values,
+// it also excludes the series without the label. It is only equivalent to the matcher of the values
+// when allValues contains all the possible values of the label
+func newExclusionMatcher(label string, values []string, allValues []string) (*labels.Matcher, error) {
+	valueSet := make(map[string]bool, len(values))
+	for _, v := range values {
+		valueSet[v] = true
+	}
+	excludedValues := []string{}
+	for _, v := range allValues {
+		if !valueSet[v] {
+			excludedValues = append(excludedValues, v)
+		}
+	}
+	return labels.NewMatcher(labels.MatchNotRegexp, label, joinQuotedValues(append(excludedValues, "")))
+}
+
+// joinQuotedValues returns the regex which matches any of the values
+func joinQuotedValues(values []string) string {
+	var value strings.Builder
+	for idx, v := range values {
+		if idx > 0 {
+			value.WriteByte('|')
+		}
+		value.WriteString(regexp.QuoteMeta(v))
+	}
+	return value.String()
+}
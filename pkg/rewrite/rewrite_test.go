@@ -3,7 +3,16 @@
 
 package rewrite
 
-import "testing"
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
 
 func TestInjectLabels(t *testing.T) {
 	caseList := []struct {
@@ -46,28 +55,63 @@ func TestInjectLabels(t *testing.T) {
 			query:    `test_metrics{cluster="A"}`,
 			label:    "cluster",
 			values:   []string{"A", "B"},
-			expected: `test_metrics{cluster="A",cluster=~"A|B"}`,
+			expected: `test_metrics{cluster="A"}`,
 		},
 		{
 			name:     "Existing label for cluster using different ops",
-			query:    `test_metrics{cluster!="A",cluster=~"C|D",cluster!~"E|F"}`,
+			query:    `test_metrics{cluster!="A",cluster=~"B|C|D",cluster!~"E|F"}`,
 			label:    "cluster",
-			values:   []string{"A", "B"},
-			expected: `test_metrics{cluster!="A",cluster!~"E|F",cluster=~"C|D",cluster=~"A|B"}`,
+			values:   []string{"A", "B", "C", "E"},
+			expected: `test_metrics{cluster=~"B|C"}`,
 		},
 		{
 			name:     "Existing label for cluster and others",
 			query:    `test_metrics{akey="value",cluster="A"}`,
 			label:    "cluster",
 			values:   []string{"A", "B"},
-			expected: `test_metrics{cluster="A",akey="value",cluster=~"A|B"}`,
+			expected: `test_metrics{akey="value",cluster="A"}`,
 		},
 		{
 			name:     "Blank in existing query",
 			query:    `test_metrics{akey = "value",  cluster = "A"}`,
 			label:    "cluster",
 			values:   []string{"A", "B"},
-			expected: `test_metrics{cluster="A",akey="value",cluster=~"A|B"}`,
+			expected: `test_metrics{akey="value",cluster="A"}`,
+		},
+		{
+			name:     "Escaped quote in existing query",
+			query:    `test_metrics{akey="a\"cluster=\"B",cluster="A"}`,
+			label:    "cluster",
+			values:   []string{"A", "B"},
+			expected: `test_metrics{akey="a\"cluster=\"B",cluster="A"}`,
+		},
+		{
+			name:     "Label name contains cluster",
+			query:    `test_metrics{subcluster="C"}`,
+			label:    "cluster",
+			values:   []string{"A", "B"},
+			expected: `test_metrics{cluster=~"A|B",subcluster="C"}`,
+		},
+		{
+			name:     "Existing label for cluster in some selectors",
+			query:    `sum(rate(test_metrics{cluster="C"}[5m])) or test_metrics{cluster="A"}`,
+			label:    "cluster",
+			values:   []string{"A", "B"},
+			expected: `sum(rate(test_metrics{cluster!~".*"}[5m])) or test_metrics{cluster="A"}`,
+		},
+		{
+			name:     "Existing label for cluster in subquery",
+			query:    `max_over_time(test_metrics{cluster=~"A|C"}[1h:5m])`,
+			label:    "cluster",
+			values:   []string{"A", "B"},
+			expected: `max_over_time(test_metrics{cluster="A"}[1h:5m])`,
+		},
+		{
+			name:     "No selector",
+			query:    `vector(1)`,
+			label:    "cluster",
+			values:   []string{"A", "B"},
+			expected: `vector(1)`,
 		},
 	}
 
@@ -82,3 +126,595 @@ func TestInjectLabels(t *testing.T) {
 		})
 	}
 }
+
+func TestInjectLabelsWithEmptyResult(t *testing.T) {
+	caseList := []struct {
+		name   string
+		query  string
+		values []string
+	}{
+		{
+			name:   "No allowed value",
+			query:  `test_metrics`,
+			values: []string{},
+		},
+		{
+			name:   "Existing label for cluster not allowed",
+			query:  `test_metrics{cluster="C"}`,
+			values: []string{"A", "B"},
+		},
+		{
+			name:   "Existing label for cluster not allowed in aggregation",
+			query:  `sum by (namespace) (rate(test_metrics{cluster="C"}[5m]))`,
+			values: []string{"A", "B"},
+		},
+		{
+			name:   "Existing label for cluster not allowed in all selectors",
+			query:  `test_metrics{cluster="C"} / on(cluster) other_metrics{cluster!~"A|B"}`,
+			values: []string{"A", "B"},
+		},
+	}
+
+	for _, c := range caseList {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := InjectLabels(c.query, "cluster", c.values)
+			if !errors.Is(err, ErrEmptyResult) {
+				t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, ErrEmptyResult)
+			}
+		})
+	}
+}
+
+func TestInjectLabelsWithResultWithoutSeries(t *testing.T) {
+	caseList := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:     "Default value",
+			query:    `count(test_metrics{cluster="C"}) or vector(0)`,
+			expected: `count(test_metrics{cluster!~".*"}) or vector(0)`,
+		},
+		{
+			name:     "Absent series",
+			query:    `absent(test_metrics{cluster="C"})`,
+			expected: `absent(test_metrics{cluster!~".*"})`,
+		},
+		{
+			name:     "Absent series over time",
+			query:    `absent_over_time(test_metrics{cluster="C"}[5m])`,
+			expected: `absent_over_time(test_metrics{cluster!~".*"}[5m])`,
+		},
+		{
+			name:     "Scalar result",
+			query:    `scalar(test_metrics{cluster="C"})`,
+			expected: `scalar(test_metrics{cluster!~".*"})`,
+		},
+	}
+
+	for _, c := range caseList {
+		t.Run(c.name, func(t *testing.T) {
+			output, err := InjectLabels(c.query, "cluster", []string{"A", "B"})
+			if err != nil {
+				t.Errorf("Encountered error during label injection: (%v)", err)
+			} else if output != c.expected {
+				t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+			}
+		})
+	}
+}
+
+func TestInjectMatchers(t *testing.T) {
+	caseList := []struct {
+		name     string
+		query    string
+		matchers []*labels.Matcher
+		expected string
+	}{
+		{
+			name:     "Equal matcher",
+			query:    `test_metrics{key="value"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "cluster", "A")},
+			expected: `test_metrics{cluster="A",key="value"}`,
+		},
+		{
+			name:     "Equal matcher with existing equal label",
+			query:    `test_metrics{cluster="A"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "cluster", "A")},
+			expected: `test_metrics{cluster="A"}`,
+		},
+		{
+			name:     "Equal matcher with existing not equal label",
+			query:    `test_metrics{cluster!="B"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "cluster", "A")},
+			expected: `test_metrics{cluster="A"}`,
+		},
+		{
+			name:     "Equal matcher with existing regex label",
+			query:    `test_metrics{cluster=~"A.*"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "cluster", "A1")},
+			expected: `test_metrics{cluster="A1"}`,
+		},
+		{
+			name:     "Equal matcher with existing not regex label",
+			query:    `test_metrics{cluster!~"B.*"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "cluster", "A")},
+			expected: `test_metrics{cluster="A"}`,
+		},
+		{
+			name:     "Regex alternation matcher",
+			query:    `test_metrics`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "cluster", "A|B")},
+			expected: `test_metrics{cluster=~"A|B"}`,
+		},
+		{
+			name:     "Regex alternation matcher with existing equal label",
+			query:    `test_metrics{cluster="B"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "cluster", "A|B")},
+			expected: `test_metrics{cluster="B"}`,
+		},
+		{
+			name:     "Regex alternation matcher with existing not equal label",
+			query:    `test_metrics{cluster!="B"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "cluster", "A|B|C")},
+			expected: `test_metrics{cluster=~"A|C"}`,
+		},
+		{
+			name:     "Regex alternation matcher with existing regex label",
+			query:    `test_metrics{cluster=~"[AB]"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "cluster", "A|B|C")},
+			expected: `test_metrics{cluster=~"A|B"}`,
+		},
+		{
+			name:     "Regex alternation matcher with existing not regex label",
+			query:    `test_metrics{cluster!~"A|B"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "cluster", "A|B|C")},
+			expected: `test_metrics{cluster="C"}`,
+		},
+		{
+			name:     "Regex alternation matcher with escaped values",
+			query:    `test_metrics{cluster!="a.b"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "cluster", `a\.b|a\|b`)},
+			expected: `test_metrics{cluster="a|b"}`,
+		},
+		{
+			name:     "Regex matcher",
+			query:    `test_metrics{cluster="A"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "cluster", "A.*")},
+			expected: `test_metrics{cluster="A",cluster=~"A.*"}`,
+		},
+		{
+			name:     "Not equal matcher",
+			query:    `test_metrics{cluster=~"A|B"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchNotEqual, "namespace", "kube-system")},
+			expected: `test_metrics{cluster=~"A|B",namespace!="kube-system"}`,
+		},
+		{
+			name:     "Not equal matcher with existing label",
+			query:    `test_metrics{namespace!="kube-system"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchNotEqual, "namespace", "kube-system")},
+			expected: `test_metrics{namespace!="kube-system"}`,
+		},
+		{
+			name:     "Not regex matcher",
+			query:    `test_metrics{namespace="default"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchNotRegexp, "namespace", "openshift-.*")},
+			expected: `test_metrics{namespace!~"openshift-.*",namespace="default"}`,
+		},
+		{
+			name:  "Multiple labels",
+			query: `sum by (namespace) (rate(test_metrics{cluster=~"A|C",namespace="default"}[5m]))`,
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchRegexp, "cluster", "A|B"),
+				labels.MustNewMatcher(labels.MatchRegexp, "namespace", "default|test"),
+				labels.MustNewMatcher(labels.MatchNotRegexp, "pod", "debug-.*"),
+			},
+			expected: `sum by(namespace) (rate(test_metrics{cluster="A",namespace="default",pod!~"debug-.*"}[5m]))`,
+		},
+		{
+			name:  "Multiple matchers for the same label",
+			query: `test_metrics`,
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchNotEqual, "cluster", "A"),
+				labels.MustNewMatcher(labels.MatchRegexp, "cluster", "A|B"),
+			},
+			expected: `test_metrics{cluster="B"}`,
+		},
+		{
+			name:  "Matchers for some selectors are empty",
+			query: `test_metrics{namespace="other"} or test_metrics`,
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "cluster", "A"),
+				labels.MustNewMatcher(labels.MatchEqual, "namespace", "default"),
+			},
+			expected: `test_metrics{cluster="A",namespace!~".*"} or test_metrics{cluster="A",namespace="default"}`,
+		},
+	}
+
+	for _, c := range caseList {
+		t.Run(c.name, func(t *testing.T) {
+			output, err := InjectMatchers(c.query, c.matchers)
+			if err != nil {
+				t.Errorf("Encountered error during matcher injection: (%v)", err)
+			} else if output != c.expected {
+				t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+			}
+		})
+	}
+}
+
+func TestInjectMetricNameMatchers(t *testing.T) {
+	caseList := []struct {
+		name     string
+		query    string
+		matchers []*labels.Matcher
+		expected string
+	}{
+		{
+			name:     "Allowed metric names",
+			query:    `foo + up`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "up|process_cpu_seconds_total")},
+			expected: `{__name__!~".*"} + up`,
+		},
+		{
+			name:     "Allowed metric names with existing name matcher",
+			query:    `{__name__=~"up|foo"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "up|process_cpu_seconds_total")},
+			expected: `up`,
+		},
+		{
+			name:     "Allowed metric name patterns",
+			query:    `rate(foo[5m]) / node_load1`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "node_.*")},
+			expected: `rate({__name__!~".*"}[5m]) / node_load1`,
+		},
+		{
+			name:     "Denied metric name patterns",
+			query:    `foo + go_goroutines`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchNotRegexp, labels.MetricName, "go_.*")},
+			expected: `foo + {__name__!~".*"}`,
+		},
+		{
+			name:     "Denied metric name patterns without name",
+			query:    `{job="node"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchNotRegexp, labels.MetricName, "go_.*")},
+			expected: `{__name__!~"go_.*",job="node"}`,
+		},
+	}
+
+	for _, c := range caseList {
+		t.Run(c.name, func(t *testing.T) {
+			output, err := InjectMatchers(c.query, c.matchers)
+			if err != nil {
+				t.Errorf("Encountered error during matcher injection: (%v)", err)
+				return
+			}
+			if output != c.expected {
+				t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+			}
+			// the rewritten query is sent to upstream, so it must be parsed again
+			if _, err := parser.ParseExpr(output); err != nil {
+				t.Errorf("case (%v) failed to parse the output (%v): %v", c.name, output, err)
+			}
+		})
+	}
+}
+
+func TestInjectMatchersWithEmptyResult(t *testing.T) {
+	caseList := []struct {
+		name     string
+		query    string
+		matchers []*labels.Matcher
+	}{
+		{
+			name:     "Equal matcher with different existing label",
+			query:    `test_metrics{cluster="B"}`,
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "cluster", "A")},
+		},
+		{
+			name:  "One of multiple labels is empty",
+			query: `test_metrics{namespace="other"}`,
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "cluster", "A"),
+				labels.MustNewMatcher(labels.MatchRegexp, "namespace", "default|test"),
+			},
+		},
+	}
+
+	for _, c := range caseList {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := InjectMatchers(c.query, c.matchers)
+			if !errors.Is(err, ErrEmptyResult) {
+				t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, ErrEmptyResult)
+			}
+		})
+	}
+}
+
+func TestInjectScopedLabels(t *testing.T) {
+	scope := map[string][]string{
+		"A": {"ns1", "ns2"},
+		"B": {"ns1", "ns2"},
+		"C": {"ns3", ""},
+	}
+	caseList := []struct {
+		name     string
+		query    string
+		expected string
+		err      error
+	}{
+		{
+			name:     "Clusters with same scope",
+			query:    `test_metrics{cluster=~"A|B"}`,
+			expected: `test_metrics{cluster=~"A|B",namespace=~"ns1|ns2"}`,
+		},
+		{
+			name:     "Cluster with existing namespace",
+			query:    `test_metrics{cluster="A",namespace!="ns1"}`,
+			expected: `test_metrics{cluster="A",namespace="ns2"}`,
+		},
+		{
+			name:     "Cluster allows series without namespace",
+			query:    `test_metrics{cluster="C"}`,
+			expected: `test_metrics{cluster="C",namespace=~"ns3|"}`,
+		},
+		{
+			name:     "Namespace selects the clusters",
+			query:    `test_metrics{namespace="ns3"} / on(cluster) other_metrics{cluster!="C"}`,
+			expected: `test_metrics{cluster="C",namespace="ns3"} / on(cluster) other_metrics{cluster=~"A|B",namespace=~"ns1|ns2"}`,
+		},
+		{
+			name:     "Namespace selects the clusters with same scope",
+			query:    `test_metrics{namespace="ns1"}`,
+			expected: `test_metrics{cluster=~"A|B",namespace="ns1"}`,
+		},
+		{
+			name:     "Clusters with different scopes",
+			query:    `test_metrics`,
+			expected: `(test_metrics{cluster=~"A|B",namespace=~"ns1|ns2"} or test_metrics{cluster="C",namespace=~"ns3|"})`,
+		},
+		{
+			name:  "Aggregation of clusters with different scopes",
+			query: `topk(3, test_metrics offset 5m)`,
+			expected: `topk(3, (test_metrics{cluster=~"A|B",namespace=~"ns1|ns2"} offset 5m or ` +
+				`test_metrics{cluster="C",namespace=~"ns3|"} offset 5m))`,
+		},
+		{
+			name:  "Function of range vector with different scopes",
+			query: `sum by(cluster) (rate(test_metrics[5m]))`,
+			expected: `sum by(cluster) ((rate(test_metrics{cluster=~"A|B",namespace=~"ns1|ns2"}[5m]) or ` +
+				`rate(test_metrics{cluster="C",namespace=~"ns3|"}[5m])))`,
+		},
+		{
+			name:  "Subquery with different scopes",
+			query: `max_over_time(test_metrics[1h:5m])`,
+			expected: `max_over_time((test_metrics{cluster=~"A|B",namespace=~"ns1|ns2"} or ` +
+				`test_metrics{cluster="C",namespace=~"ns3|"})[1h:5m])`,
+		},
+		{
+			name:  "Absent range vector with different scopes",
+			query: `absent_over_time(test_metrics[5m])`,
+			err:   ErrAmbiguousScope,
+		},
+		{
+			name:  "Range vector with different scopes",
+			query: `test_metrics[5m]`,
+			err:   ErrAmbiguousScope,
+		},
+		{
+			name:  "Namespace not allowed",
+			query: `test_metrics{cluster="A",namespace="ns3"}`,
+			err:   ErrEmptyResult,
+		},
+	}
+
+	for _, c := range caseList {
+		t.Run(c.name, func(t *testing.T) {
+			output, err := InjectScopedLabels(c.query, "cluster", "namespace", scope)
+			if c.err != nil {
+				if !errors.Is(err, c.err) {
+					t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, c.err)
+				}
+			} else if err != nil {
+				t.Errorf("Encountered error during label injection: (%v)", err)
+			} else if output != c.expected {
+				t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+			} else if _, err := parser.ParseExpr(output); err != nil {
+				t.Errorf("case (%v) output: (%v) cannot be parsed: (%v)", c.name, output, err)
+			}
+		})
+	}
+}
+
+func TestInjectScopedLabelsWithUnrestrictedScope(t *testing.T) {
+	scope := map[string][]string{
+		"A": {"ns1", "ns2"},
+		"B": nil,
+	}
+	caseList := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:     "Cluster with unrestricted scope",
+			query:    `test_metrics{cluster="B",namespace!="ns1"}`,
+			expected: `test_metrics{cluster="B",namespace!="ns1"}`,
+		},
+		{
+			name:     "Clusters with restricted and unrestricted scopes",
+			query:    `test_metrics{namespace!="ns1"}`,
+			expected: `(test_metrics{cluster="A",namespace="ns2"} or test_metrics{cluster="B",namespace!="ns1"})`,
+		},
+	}
+
+	for _, c := range caseList {
+		output, err := InjectScopedLabels(c.query, "cluster", "namespace", scope)
+		if err != nil {
+			t.Errorf("Encountered error during label injection: (%v)", err)
+		} else if output != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+	}
+}
+
+func TestInjectScopedLabelsSelectors(t *testing.T) {
+	scope := map[string][]string{
+		"A": {"ns1", "ns2"},
+		"B": {"ns1", "ns2"},
+		"C": {"ns3", ""},
+	}
+	caseList := []struct {
+		name     string
+		selector string
+		expected []string
+	}{
+		{
+			name:     "Clusters with same scope",
+			selector: `{namespace="ns3"}`,
+			expected: []string{`{cluster="C",namespace="ns3"}`},
+		},
+		{
+			name:     "Clusters with different scopes",
+			selector: `test_metrics{job="j"}`,
+			expected: []string{
+				`test_metrics{cluster=~"A|B",job="j",namespace=~"ns1|ns2"}`,
+				`test_metrics{cluster="C",job="j",namespace=~"ns3|"}`,
+			},
+		},
+	}
+
+	for _, c := range caseList {
+		output, err := InjectScopedLabelsSelectors(c.selector, "cluster", "namespace", scope)
+		if err != nil {
+			t.Errorf("Encountered error during label injection: (%v)", err)
+		} else if !reflect.DeepEqual(output, c.expected) {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+	}
+}
+
+func TestLiteralValues(t *testing.T) {
+	caseList := []struct {
+		name     string
+		matcher  *labels.Matcher
+		expected []string
+		finite   bool
+	}{
+		{"Equal", labels.MustNewMatcher(labels.MatchEqual, "l", "a.b"), []string{"a.b"}, true},
+		{"Alternation", labels.MustNewMatcher(labels.MatchRegexp, "l", "a|b|"), []string{"a", "b", ""}, true},
+		{"Escaped alternation", labels.MustNewMatcher(labels.MatchRegexp, "l", `a\.b|c\\d`), []string{"a.b", `c\d`}, true},
+		{"Wildcard", labels.MustNewMatcher(labels.MatchRegexp, "l", "a.*"), nil, false},
+		{"Escape class", labels.MustNewMatcher(labels.MatchRegexp, "l", `a\d`), nil, false},
+		{"Not equal", labels.MustNewMatcher(labels.MatchNotEqual, "l", "a"), nil, false},
+		{"Not regex", labels.MustNewMatcher(labels.MatchNotRegexp, "l", "a|b"), nil, false},
+	}
+
+	for _, c := range caseList {
+		output, finite := literalValues(c.matcher)
+		if finite != c.finite || strings.Join(output, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("case (%v) output: (%v, %v) is not the expected: (%v, %v)", c.name, output, finite, c.expected, c.finite)
+		}
+	}
+}
+
+func TestInjectLabelsWithExclusion(t *testing.T) {
+	allValues := []string{"A", "B", "C", "D", "E"}
+	caseList := []struct {
+		name     string
+		query    string
+		values   []string
+		expected string
+	}{
+		{
+			name:     "Few allowed values",
+			query:    `test_metrics`,
+			values:   []string{"A", "B"},
+			expected: `test_metrics{cluster=~"A|B"}`,
+		},
+		{
+			name:     "Most values allowed",
+			query:    `test_metrics`,
+			values:   []string{"A", "B", "C", "D"},
+			expected: `test_metrics{cluster!~"E|"}`,
+		},
+		{
+			name:     "All values allowed",
+			query:    `test_metrics`,
+			values:   allValues,
+			expected: `test_metrics{cluster!~""}`,
+		},
+		{
+			name:     "Existing label for cluster",
+			query:    `test_metrics{cluster!="A"}`,
+			values:   []string{"A", "B", "C", "D"},
+			expected: `test_metrics{cluster!="A",cluster!~"E|"}`,
+		},
+		{
+			name:     "Existing regex label for cluster",
+			query:    `test_metrics{cluster=~"[A-D]"}`,
+			values:   []string{"A", "B", "C", "D"},
+			expected: `test_metrics{cluster!~"E|",cluster=~"[A-D]"}`,
+		},
+		{
+			name:     "Existing label for cluster with single value",
+			query:    `test_metrics{cluster="C"}`,
+			values:   []string{"A", "B", "C", "D"},
+			expected: `test_metrics{cluster="C"}`,
+		},
+	}
+
+	for _, c := range caseList {
+		t.Run(c.name, func(t *testing.T) {
+			output, err := InjectLabelsWithExclusion(c.query, "cluster", c.values, allValues)
+			if err != nil {
+				t.Errorf("Encountered error during label injection: (%v)", err)
+			} else if output != c.expected {
+				t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+			}
+		})
+	}
+}
+
+func TestInjectLabelsWithRegexMetaChars(t *testing.T) {
+	output, err := InjectLabels(`test_metrics{cluster!="a.b"}`, "cluster", []string{"a.b", "a+b", "a|b", "axb"})
+	expected := `test_metrics{cluster=~"a\\+b|a\\|b|axb"}`
+	if err != nil {
+		t.Errorf("Encountered error during label injection: (%v)", err)
+	} else if output != expected {
+		t.Errorf("output: (%v) is not the expected: (%v)", output, expected)
+	}
+}
+
+func newFleet(size int) []string {
+	clusters := make([]string, size)
+	for idx := range clusters {
+		clusters[idx] = fmt.Sprintf("managed-cluster-%05d", idx)
+	}
+	return clusters
+}
+
+func BenchmarkInjectLabels(b *testing.B) {
+	query := `sum by (cluster) (rate(container_cpu_usage_seconds_total{namespace="default"}[5m]))`
+	for _, size := range []int{10, 100, 1000, 10000} {
+		allValues := newFleet(size)
+		for _, ratio := range []int{10, 90} {
+			values := allValues[:size*ratio/100]
+			b.Run(fmt.Sprintf("fleet=%d/allowed=%d%%/positive", size, ratio), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := InjectLabels(query, "cluster", values); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run(fmt.Sprintf("fleet=%d/allowed=%d%%/exclusion", size, ratio), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := InjectLabelsWithExclusion(query, "cluster", values, allValues); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+)
+
+const (
+	clusterAPIGroup     = "cluster.open-cluster-management.io"
+	accessReviewWorkers = 10
+)
+
+var accessReviewer *AccessReviewer
+
+// SetAccessReviewer is used to decide the accessible clusters with the access reviews of the reviewer
+// instead of the project list of the user, nil is used to disable the access reviews
+func SetAccessReviewer(reviewer *AccessReviewer) {
+	accessReviewer = reviewer
+}
+
+// UsesAccessReview checks whether the accessible clusters are decided with the access reviews
+func UsesAccessReview() bool {
+	return accessReviewer != nil
+}
+
+// AccessReviewer decides the accessible managed clusters of the user with the SelfSubjectAccessReview
+// of the user token, so that the groups of the user are taken into account without trusting any header.
+// The reviews of a request are sent in parallel and the decisions are cached for each token
+type AccessReviewer struct {
+	newClient   func(token string, imp *Impersonation) (kubernetes.Interface, error)
+	verb        string
+	subresource string
+	ttl         time.Duration
+
+	mutex sync.Mutex
+	// decisions maps the keyed hashes of the tokens and impersonations to their decisions
+	decisions map[string]*tokenDecisions
+}
+
+// tokenDecisions are the cached decisions of the access reviews of a token
+type tokenDecisions struct {
+	expiry  time.Time
+	allowed map[authorizationv1.ResourceAttributes]bool
+}
+
+// NewAccessReviewer returns the reviewer which checks whether the user can access the managed
+// clusters with the verb and the subresource, e.g. get managedclusters/<name>. The access reviews
+// are sent to the api server of the config with the user token, the decisions are cached for the ttl.
+// The reviews of an impersonation are sent with the impersonation headers of the user and groups
+func NewAccessReviewer(config *rest.Config, verb, subresource string, ttl time.Duration) *AccessReviewer {
+	return newAccessReviewer(func(token string, imp *Impersonation) (kubernetes.Interface, error) {
+		userConfig := rest.AnonymousClientConfig(config)
+		userConfig.BearerToken = token
+		if imp != nil {
+			userConfig.Impersonate = rest.ImpersonationConfig{UserName: imp.UserName, Groups: imp.Groups}
+		}
+		return kubernetes.NewForConfig(userConfig)
+	}, verb, subresource, ttl)
+}
+
+func newAccessReviewer(newClient func(token string, imp *Impersonation) (kubernetes.Interface, error),
+	verb, subresource string, ttl time.Duration) *AccessReviewer {
+	return &AccessReviewer{
+		newClient:   newClient,
+		verb:        verb,
+		subresource: subresource,
+		ttl:         ttl,
+		decisions:   map[string]*tokenDecisions{},
+	}
+}
+
+// AuthorizedClusters returns the clusters accessible by the user of the token or the impersonated user, true is
+// returned when the user can access the managed clusters of any name, e.g. with a ClusterRole on managedclusters.
+// The clusters are only reviewed one by one when the user cannot access the managed clusters of any name
+func (r *AccessReviewer) AuthorizedClusters(token string, imp *Impersonation, clusters []string) (bool, []string, error) {
+	allowed, err := r.Review(token, imp, []authorizationv1.ResourceAttributes{r.clusterAttributes("")})
+	if err != nil {
+		return false, nil, err
+	}
+	if allowed[0] {
+		return true, append([]string{}, clusters...), nil
+	}
+
+	attrsList := make([]authorizationv1.ResourceAttributes, 0, len(clusters))
+	for _, clusterName := range clusters {
+		attrsList = append(attrsList, r.clusterAttributes(clusterName))
+	}
+	allowed, err = r.Review(token, imp, attrsList)
+	if err != nil {
+		return false, nil, err
+	}
+
+	authorized := []string{}
+	for idx, clusterName := range clusters {
+		if allowed[idx] {
+			authorized = append(authorized, clusterName)
+		}
+	}
+	return false, authorized, nil
+}
+
+func (r *AccessReviewer) clusterAttributes(clusterName string) authorizationv1.ResourceAttributes {
+	return authorizationv1.ResourceAttributes{
+		Verb:        r.verb,
+		Group:       clusterAPIGroup,
+		Resource:    "managedclusters",
+		Subresource: r.subresource,
+		Name:        clusterName,
+	}
+}
+
+// Review checks whether the user of the token, or the user impersonated with the token when imp is not nil,
+// is allowed for each of the resource attributes, the decisions which are not cached are reviewed in parallel.
+// An error is returned when any review fails
+func (r *AccessReviewer) Review(token string, imp *Impersonation,
+	attrsList []authorizationv1.ResourceAttributes) ([]bool, error) {
+	allowed := make([]bool, len(attrsList))
+	pending := []authorizationv1.ResourceAttributes{}
+	pendingSet := map[authorizationv1.ResourceAttributes]bool{}
+	key := tokenKey(imp.cacheKey(token))
+	r.mutex.Lock()
+	decisions, ok := r.decisions[key]
+	if !ok || time.Now().After(decisions.expiry) {
+		decisions = &tokenDecisions{
+			expiry:  time.Now().Add(r.ttl),
+			allowed: map[authorizationv1.ResourceAttributes]bool{},
+		}
+		r.decisions[key] = decisions
+	}
+	for idx, attrs := range attrsList {
+		decision, ok := decisions.allowed[attrs]
+		if ok {
+			allowed[idx] = decision
+		} else if !pendingSet[attrs] {
+			pendingSet[attrs] = true
+			pending = append(pending, attrs)
+		}
+	}
+	r.mutex.Unlock()
+	if len(pending) == 0 {
+		return allowed, nil
+	}
+
+	client, err := r.newClient(token, imp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client for access review: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	reviewed := make([]bool, len(pending))
+	errs := make([]error, len(pending))
+	workers := make(chan struct{}, accessReviewWorkers)
+	for idx := range pending {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(idx int) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			reviewed[idx], errs[idx] = reviewAccess(client, pending[idx])
+		}(idx)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reviewedDecisions := make(map[authorizationv1.ResourceAttributes]bool, len(pending))
+	r.mutex.Lock()
+	for idx, attrs := range pending {
+		decisions.allowed[attrs] = reviewed[idx]
+		reviewedDecisions[attrs] = reviewed[idx]
+	}
+	r.mutex.Unlock()
+	for idx, attrs := range attrsList {
+		if decision, ok := reviewedDecisions[attrs]; ok {
+			allowed[idx] = decision
+		}
+	}
+	klog.V(1).Infof("reviewed %v of %v resource attributes", len(pending), len(attrsList))
+	return allowed, nil
+}
+
+// CleanExpiredDecisions removes the expired decisions periodically
+func (r *AccessReviewer) CleanExpiredDecisions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		r.mutex.Lock()
+		for key, decisions := range r.decisions {
+			if time.Now().After(decisions.expiry) {
+				delete(r.decisions, key)
+			}
+		}
+		r.mutex.Unlock()
+	}
+}
+
+func reviewAccess(client kubernetes.Interface, attrs authorizationv1.ResourceAttributes) (bool, error) {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &attrs,
+		},
+	}
+	review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(context.TODO(), review, metav1.CreateOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to create access review for %s %s/%s: %v",
+			attrs.Verb, attrs.Resource, attrs.Name, err)
+	}
+	return review.Status.Allowed, nil
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// newFakeAccessReviewer returns the reviewer whose access reviews are allowed by the allowed func of the
+// token, or of the impersonated user name, the number of sent reviews is counted by reviews
+func newFakeAccessReviewer(allowed func(token string, attrs *authorizationv1.ResourceAttributes) (bool, error),
+	reviews *int64) *AccessReviewer {
+	return newAccessReviewer(func(token string, imp *Impersonation) (kubernetes.Interface, error) {
+		if imp != nil {
+			token = imp.UserName
+		}
+		client := fake.NewSimpleClientset()
+		client.PrependReactor("create", "selfsubjectaccessreviews",
+			func(action clienttesting.Action) (bool, runtime.Object, error) {
+				atomic.AddInt64(reviews, 1)
+				review := action.(clienttesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+				ok, err := allowed(token, review.Spec.ResourceAttributes)
+				review.Status.Allowed = ok
+				return true, review, err
+			})
+		return client, nil
+	}, "get", "", time.Minute)
+}
+
+func allowClusters(clusters ...string) func(string, *authorizationv1.ResourceAttributes) (bool, error) {
+	return func(token string, attrs *authorizationv1.ResourceAttributes) (bool, error) {
+		if attrs.Group != clusterAPIGroup || attrs.Resource != "managedclusters" || attrs.Verb != "get" {
+			return false, nil
+		}
+		return token == "admin" || (attrs.Name != "" && Contains(clusters, attrs.Name)), nil
+	}
+}
+
+func TestAuthorizedClusters(t *testing.T) {
+	testCaseList := []struct {
+		name        string
+		token       string
+		allClusters bool
+		expected    []string
+	}{
+		{"user with cluster access", "user", false, []string{"c1", "c3"}},
+		{"user with access to all clusters", "admin", true, []string{"c1", "c2", "c3"}},
+	}
+
+	var reviews int64
+	reviewer := newFakeAccessReviewer(allowClusters("c1", "c3"), &reviews)
+	for _, c := range testCaseList {
+		allClusters, output, err := reviewer.AuthorizedClusters(c.token, nil, []string{"c1", "c2", "c3"})
+		if err != nil {
+			t.Errorf("case (%v) failed to review access: %v", c.name, err)
+		}
+		if allClusters != c.allClusters || !reflect.DeepEqual(output, c.expected) {
+			t.Errorf("case (%v) output: (%v, %v) is not the expected: (%v, %v)",
+				c.name, allClusters, output, c.allClusters, c.expected)
+		}
+	}
+
+	// the clusters are not reviewed one by one when the user can access the managed clusters of any name
+	reviews = 0
+	reviewer = newFakeAccessReviewer(allowClusters("c1", "c3"), &reviews)
+	allClusters, output, err := reviewer.AuthorizedClusters("admin", nil, []string{"c1", "c2", "c3"})
+	if err != nil || !allClusters || reviews != 1 || !reflect.DeepEqual(output, []string{"c1", "c2", "c3"}) {
+		t.Errorf("case (admin reviews) output: (%v, %v, %v) is not the expected: (%v, %v, %v)",
+			allClusters, output, reviews, true, []string{"c1", "c2", "c3"}, 1)
+	}
+	_, _, _ = reviewer.AuthorizedClusters("user", nil, []string{"c1", "c2", "c3"})
+
+	// the decisions are cached, only the new cluster is reviewed
+	reviews = 0
+	_, output, _ = reviewer.AuthorizedClusters("user", nil, []string{"c1", "c2", "c3", "c4"})
+	if reviews != 1 || !reflect.DeepEqual(output, []string{"c1", "c3"}) {
+		t.Errorf("output: (%v, %v) is not the expected: (%v, %v)", reviews, output, 1, []string{"c1", "c3"})
+	}
+}
+
+func TestAuthorizedClustersWithExpiredDecisions(t *testing.T) {
+	var reviews int64
+	reviewer := newFakeAccessReviewer(allowClusters("c1"), &reviews)
+	reviewer.ttl = 0
+	for i := 0; i < 2; i++ {
+		if _, _, err := reviewer.AuthorizedClusters("user", nil, []string{"c1", "c2"}); err != nil {
+			t.Errorf("failed to review access: %v", err)
+		}
+	}
+	if reviews != 6 {
+		t.Errorf("reviews: (%v) is not the expected: (%v)", reviews, 6)
+	}
+}
+
+func TestAuthorizedClustersWithFailedReview(t *testing.T) {
+	var reviews int64
+	reviewer := newFakeAccessReviewer(func(token string, attrs *authorizationv1.ResourceAttributes) (bool, error) {
+		return attrs.Name == "c1", nil
+	}, &reviews)
+	if _, _, err := reviewer.AuthorizedClusters("user", nil, []string{"c1"}); err != nil {
+		t.Errorf("failed to review access: %v", err)
+	}
+
+	reviewer.newClient = newFakeAccessReviewer(func(token string, attrs *authorizationv1.ResourceAttributes) (bool, error) {
+		return false, errors.New("server error")
+	}, &reviews).newClient
+	if _, _, err := reviewer.AuthorizedClusters("user", nil, []string{"c1", "c2"}); err == nil {
+		t.Errorf("failed to get error for failed access review")
+	}
+
+	// the failed decisions are not cached
+	reviews = 0
+	reviewer.newClient = newFakeAccessReviewer(allowClusters("c2"), &reviews).newClient
+	_, output, err := reviewer.AuthorizedClusters("user", nil, []string{"c1", "c2"})
+	if err != nil || reviews != 1 || !reflect.DeepEqual(output, []string{"c1", "c2"}) {
+		t.Errorf("output: (%v, %v, %v) is not the expected: (%v, %v, %v)", output, reviews, err, []string{"c1", "c2"}, 1, nil)
+	}
+}
+
+func TestGetUserAccessWithAccessReview(t *testing.T) {
+	var reviews int64
+	defer SetAccessReviewer(nil)
+	allManagedClusterNames = map[string]string{"c1": "c1", "c2": "c2"}
+	testCaseList := []struct {
+		name     string
+		reviewer *AccessReviewer
+		expected *UserAccess
+	}{
+		{
+			"reviewed clusters",
+			newFakeAccessReviewer(allowClusters("c2"), &reviews),
+			NewUserAccess("test", false, []string{"c2"}, nil),
+		},
+		{
+			"failed access review",
+			newFakeAccessReviewer(func(token string, attrs *authorizationv1.ResourceAttributes) (bool, error) {
+				return true, errors.New("server error")
+			}, &reviews),
+			NewUserAccess("test", false, []string{}, nil),
+		},
+	}
+
+	for _, c := range testCaseList {
+		SetAccessReviewer(c.reviewer)
+		req, _ := http.NewRequest("GET", "http://127.0.0.1:3002/api/v1/query?query=foo", nil)
+		req.Header.Set("X-Forwarded-User", "test")
+		req.Header.Set("X-Forwarded-Access-Token", "user")
+		output := GetUserAccess(req, "http://127.0.0.1:3002/")
+		c.expected.Groups = []string{}
+		if !reflect.DeepEqual(output, c.expected) {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+	}
+}
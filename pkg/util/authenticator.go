@@ -0,0 +1,191 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	userv1 "github.com/openshift/api/user/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// forwardedGroupsHeader is the header with the comma separated groups of the user
+const forwardedGroupsHeader = "X-Forwarded-Groups"
+
+// trustForwardedGroups accepts the user and groups of the X-Forwarded-User and X-Forwarded-Groups headers
+// sent by the front end, e.g. oauth-proxy, otherwise they are the identity of the token resolved by the authenticator
+var trustForwardedGroups = false
+
+// SetTrustForwardedGroups is used to trust or distrust the X-Forwarded-Groups header of the requests
+func SetTrustForwardedGroups(trust bool) {
+	trustForwardedGroups = trust
+}
+
+// TrustsForwardedGroups checks whether the X-Forwarded-Groups header of the requests is trusted
+func TrustsForwardedGroups() bool {
+	return trustForwardedGroups
+}
+
+// GetForwardedGroups returns the groups of the X-Forwarded-Groups header
+func GetForwardedGroups(req *http.Request) []string {
+	groups := []string{}
+	for _, value := range req.Header.Values(forwardedGroupsHeader) {
+		for _, group := range strings.Split(value, ",") {
+			group = strings.TrimSpace(group)
+			if group != "" && !Contains(groups, group) {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups
+}
+
+// SetForwardedGroups replaces the X-Forwarded-Groups header with the groups
+func SetForwardedGroups(req *http.Request, groups []string) {
+	req.Header.Del(forwardedGroupsHeader)
+	if len(groups) > 0 {
+		req.Header.Set(forwardedGroupsHeader, strings.Join(groups, ","))
+	}
+}
+
+// UserInfo is the identity of the user of a token
+type UserInfo struct {
+	Name   string
+	Groups []string
+	// Expiry is when the token expires, it is zero when the expiry of the token is unknown
+	Expiry time.Time
+}
+
+// GetClientCertUser returns the user of the client certificate verified by the tls server,
+// the common name of the subject is the user name and the organizations are the groups
+func GetClientCertUser(req *http.Request) (*UserInfo, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	subject := req.TLS.VerifiedChains[0][0].Subject
+	if subject.CommonName == "" {
+		return nil, false
+	}
+	groups := []string{}
+	for _, group := range subject.Organization {
+		if group != "" && !Contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	return &UserInfo{Name: subject.CommonName, Groups: groups}, true
+}
+
+// Authenticator resolves the identity of the user from the bearer token
+type Authenticator interface {
+	Authenticate(token string) (*UserInfo, error)
+}
+
+// openShiftAuthenticator resolves the user with the user API of OpenShift
+type openShiftAuthenticator struct {
+	url string
+}
+
+// NewOpenShiftAuthenticator returns the authenticator which gets the user from
+// the url of the OpenShift user API, e.g. /apis/user.openshift.io/v1/users/~
+func NewOpenShiftAuthenticator(url string) Authenticator {
+	return &openShiftAuthenticator{url: url}
+}
+
+func (a *openShiftAuthenticator) Authenticate(token string) (*UserInfo, error) {
+	resp, err := sendHTTPRequest(a.url, "GET", token)
+	if err != nil {
+		writeError(fmt.Sprintf("failed to send http request: %v", err))
+		return nil, fmt.Errorf("failed to send http request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get user: %v", resp.Status)
+	}
+
+	user := userv1.User{}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, fmt.Errorf("failed to decode response json body: %v", err)
+	}
+	if user.Name == "" {
+		return nil, errors.New("no user name found in response")
+	}
+	return &UserInfo{Name: user.Name, Groups: user.Groups}, nil
+}
+
+// tokenReviewAuthenticator resolves the user with the TokenReview API of kubernetes
+type tokenReviewAuthenticator struct {
+	client kubernetes.Interface
+}
+
+// NewTokenReviewAuthenticator returns the authenticator which reviews the
+// token with the TokenReview API, it works on the kubernetes hubs without OpenShift
+func NewTokenReviewAuthenticator(client kubernetes.Interface) Authenticator {
+	return &tokenReviewAuthenticator{client: client}
+}
+
+func (a *tokenReviewAuthenticator) Authenticate(token string) (*UserInfo, error) {
+	review := &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token: strings.TrimPrefix(token, "Bearer "),
+		},
+	}
+	review, err := a.client.AuthenticationV1().TokenReviews().Create(context.TODO(), review, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token review: %v", err)
+	}
+	if !review.Status.Authenticated {
+		return nil, fmt.Errorf("token is not authenticated: %s", review.Status.Error)
+	}
+	return &UserInfo{Name: review.Status.User.Username, Groups: review.Status.User.Groups}, nil
+}
+
+// cachedAuthenticator caches the users resolved by the authenticator for each token
+type cachedAuthenticator struct {
+	authenticator Authenticator
+	ttl           time.Duration
+	// users caches the users for the keyed hashes of the tokens
+	users *lruCache
+}
+
+// NewCachedAuthenticator returns the authenticator which caches the users resolved by the authenticator for
+// the ttl, or until their tokens expire when they expire earlier, so that the revoked tokens are not accepted
+// longer than the ttl. At most maxEntries users are cached, the least recently used users are evicted then.
+// The failed authentications are not cached
+func NewCachedAuthenticator(authenticator Authenticator, ttl time.Duration, maxEntries int) Authenticator {
+	return &cachedAuthenticator{
+		authenticator: authenticator,
+		ttl:           ttl,
+		users:         newLRUCache(maxEntries),
+	}
+}
+
+func (a *cachedAuthenticator) Authenticate(token string) (*UserInfo, error) {
+	key := tokenKey(token)
+	if cached, ok := a.users.get(key); ok {
+		return cached.(*UserInfo), nil
+	}
+
+	user, err := a.authenticator.Authenticate(token)
+	if err != nil {
+		return nil, err
+	}
+
+	expiry := time.Now().Add(a.ttl)
+	if !user.Expiry.IsZero() && user.Expiry.Before(expiry) {
+		expiry = user.Expiry
+	}
+	if a.ttl > 0 {
+		a.users.set(key, user, expiry)
+	}
+	return user, nil
+}
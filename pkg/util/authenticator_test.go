@@ -0,0 +1,214 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestOpenShiftAuthenticator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/apis/user.openshift.io/v1/users/~" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"kind":"User","apiVersion":"user.openshift.io/v1",` +
+			`"metadata":{"name":"alice"},"groups":["team-a","system:authenticated"]}`))
+	}))
+	defer server.Close()
+
+	user, err := NewOpenShiftAuthenticator(server.URL + "/apis/user.openshift.io/v1/users/~").Authenticate("")
+	if err != nil {
+		t.Errorf("failed to authenticate user: %v", err)
+	}
+	expected := &UserInfo{Name: "alice", Groups: []string{"team-a", "system:authenticated"}}
+	if !reflect.DeepEqual(user, expected) {
+		t.Errorf("output: (%v) is not the expected: (%v)", user, expected)
+	}
+
+	if _, err := NewOpenShiftAuthenticator(server.URL + "/unknown").Authenticate(""); err == nil {
+		t.Errorf("failed to get error for unknown user api")
+	}
+}
+
+func TestTokenReviewAuthenticator(t *testing.T) {
+	testCaseList := []struct {
+		name     string
+		token    string
+		expected *UserInfo
+		hasError bool
+	}{
+		{"valid token", "valid", &UserInfo{Name: "alice", Groups: []string{"team-a"}}, false},
+		{"bearer token", "Bearer valid", &UserInfo{Name: "alice", Groups: []string{"team-a"}}, false},
+		{"invalid token", "invalid", nil, true},
+	}
+
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews",
+		func(action clienttesting.Action) (bool, runtime.Object, error) {
+			review := action.(clienttesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+			if review.Spec.Token == "valid" {
+				review.Status = authenticationv1.TokenReviewStatus{
+					Authenticated: true,
+					User:          authenticationv1.UserInfo{Username: "alice", Groups: []string{"team-a"}},
+				}
+			} else {
+				review.Status = authenticationv1.TokenReviewStatus{Error: "invalid token"}
+			}
+			return true, review, nil
+		})
+
+	authenticator := NewTokenReviewAuthenticator(client)
+	for _, c := range testCaseList {
+		user, err := authenticator.Authenticate(c.token)
+		if (err != nil) != c.hasError {
+			t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, c.hasError)
+		}
+		if !reflect.DeepEqual(user, c.expected) {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, user, c.expected)
+		}
+	}
+}
+
+type fakeAuthenticator struct {
+	calls int
+	users map[string]*UserInfo
+}
+
+func (a *fakeAuthenticator) Authenticate(token string) (*UserInfo, error) {
+	a.calls++
+	user, ok := a.users[token]
+	if !ok {
+		return nil, errors.New("invalid token")
+	}
+	return user, nil
+}
+
+func TestCachedAuthenticator(t *testing.T) {
+	fake := &fakeAuthenticator{users: map[string]*UserInfo{"valid": {Name: "alice", Groups: []string{"team-a"}}}}
+	authenticator := NewCachedAuthenticator(fake, time.Minute, 0)
+	for i := 0; i < 2; i++ {
+		user, err := authenticator.Authenticate("valid")
+		if err != nil || user.Name != "alice" {
+			t.Errorf("output: (%v, %v) is not the expected: (alice, nil)", user, err)
+		}
+		if _, err := authenticator.Authenticate("invalid"); err == nil {
+			t.Errorf("failed to get error for invalid token")
+		}
+	}
+	// the valid token is authenticated once, the invalid token is not cached
+	if fake.calls != 3 {
+		t.Errorf("calls: (%v) is not the expected: (%v)", fake.calls, 3)
+	}
+
+	authenticator = NewCachedAuthenticator(fake, 0, 0)
+	fake.calls = 0
+	for i := 0; i < 2; i++ {
+		_, _ = authenticator.Authenticate("valid")
+	}
+	if fake.calls != 2 {
+		t.Errorf("calls: (%v) is not the expected: (%v)", fake.calls, 2)
+	}
+}
+
+func TestCachedAuthenticatorWithExpiry(t *testing.T) {
+	fake := &fakeAuthenticator{users: map[string]*UserInfo{
+		"expired": {Name: "alice", Expiry: time.Now().Add(-time.Second)},
+		"valid":   {Name: "bob", Expiry: time.Now().Add(time.Hour)},
+	}}
+	// the users are cached until their tokens expire when they expire before the ttl
+	authenticator := NewCachedAuthenticator(fake, 2*time.Hour, 0)
+	for i := 0; i < 2; i++ {
+		_, _ = authenticator.Authenticate("expired")
+		_, _ = authenticator.Authenticate("valid")
+	}
+	if fake.calls != 3 {
+		t.Errorf("calls: (%v) is not the expected: (%v)", fake.calls, 3)
+	}
+
+	// the users of the long lived tokens are only cached for the ttl
+	fake.users["valid"].Expiry = time.Now().Add(24 * time.Hour)
+	fake.calls = 0
+	authenticator = NewCachedAuthenticator(fake, 50*time.Millisecond, 0)
+	_, _ = authenticator.Authenticate("valid")
+	time.Sleep(100 * time.Millisecond)
+	_, _ = authenticator.Authenticate("valid")
+	if fake.calls != 2 {
+		t.Errorf("calls: (%v) is not the expected: (%v)", fake.calls, 2)
+	}
+}
+
+func TestCachedAuthenticatorWithMaxEntries(t *testing.T) {
+	fake := &fakeAuthenticator{users: map[string]*UserInfo{}}
+	for idx := 0; idx < 1000; idx++ {
+		fake.users["token"+strconv.Itoa(idx)] = &UserInfo{Name: "user" + strconv.Itoa(idx)}
+	}
+	authenticator := NewCachedAuthenticator(fake, time.Hour, 10).(*cachedAuthenticator)
+	for token := range fake.users {
+		_, _ = authenticator.Authenticate(token)
+	}
+	if stats := authenticator.users.stats(); stats.Entries != 10 || stats.Evictions != 990 {
+		t.Errorf("output: (%v, %v) is not the expected: (10, 990)", stats.Entries, stats.Evictions)
+	}
+}
+
+func TestGetForwardedGroups(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:3002/api/v1/query?query=foo", nil)
+	req.Header.Add("X-Forwarded-Groups", "team-a, sre-emea")
+	req.Header.Add("X-Forwarded-Groups", "team-a,,team-b")
+	expected := []string{"team-a", "sre-emea", "team-b"}
+	if output := GetForwardedGroups(req); !reflect.DeepEqual(output, expected) {
+		t.Errorf("output: (%v) is not the expected: (%v)", output, expected)
+	}
+
+	SetForwardedGroups(req, []string{"team-c"})
+	if output := req.Header.Values("X-Forwarded-Groups"); !reflect.DeepEqual(output, []string{"team-c"}) {
+		t.Errorf("output: (%v) is not the expected: (%v)", output, []string{"team-c"})
+	}
+	SetForwardedGroups(req, nil)
+	if output := GetForwardedGroups(req); len(output) != 0 {
+		t.Errorf("output: (%v) is not the expected: ([])", output)
+	}
+}
+
+func TestGetClientCertUser(t *testing.T) {
+	newState := func(subject pkix.Name) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: subject}}}}
+	}
+	testCaseList := []struct {
+		name     string
+		state    *tls.ConnectionState
+		expected *UserInfo
+	}{
+		{"no tls", nil, nil},
+		{"no verified certificate", &tls.ConnectionState{}, nil},
+		{"common name and organizations", newState(pkix.Name{CommonName: "robot", Organization: []string{"ops", "ops", "sre"}}),
+			&UserInfo{Name: "robot", Groups: []string{"ops", "sre"}}},
+		{"no organization", newState(pkix.Name{CommonName: "robot"}), &UserInfo{Name: "robot", Groups: []string{}}},
+		{"no common name", newState(pkix.Name{Organization: []string{"ops"}}), nil},
+	}
+
+	for _, c := range testCaseList {
+		req, _ := http.NewRequest("GET", "https://127.0.0.1:3002/api/v1/query?query=foo", nil)
+		req.TLS = c.state
+		output, ok := GetClientCertUser(req)
+		if ok != (c.expected != nil) || !reflect.DeepEqual(output, c.expected) {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+	}
+}
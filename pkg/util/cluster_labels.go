@@ -0,0 +1,51 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"reflect"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+// managedClusterLabels maps the managed clusters to their labels, it is guarded by mapMutex
+var managedClusterLabels = map[string]labels.Set{}
+
+// updateManagedClusterLabels saves the labels of the managed cluster, the caller must hold mapMutex
+func updateManagedClusterLabels(cluster *clusterv1.ManagedCluster) {
+	clusterLabels := labels.Set{}
+	for key, value := range cluster.Labels {
+		clusterLabels[key] = value
+	}
+	if old, ok := managedClusterLabels[cluster.Name]; ok && !reflect.DeepEqual(old, clusterLabels) {
+		klog.Infof("labels of managedcluster %s are changed to: %v", cluster.Name, clusterLabels)
+	}
+	managedClusterLabels[cluster.Name] = clusterLabels
+}
+
+// getClustersBySelectors returns the sorted managed clusters whose labels match any of the selectors
+func getClustersBySelectors(selectors []labels.Selector) []string {
+	if len(selectors) == 0 {
+		return nil
+	}
+
+	clusterList := []string{}
+	mapMutex.RLock()
+	for clusterName, clusterLabels := range managedClusterLabels {
+		for _, selector := range selectors {
+			if selector.Matches(clusterLabels) {
+				clusterList = append(clusterList, clusterName)
+				break
+			}
+		}
+	}
+	mapMutex.RUnlock()
+
+	sort.Strings(clusterList)
+	return clusterList
+}
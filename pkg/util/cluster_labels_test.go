@@ -0,0 +1,62 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+func newLabeledManagedCluster(name string, clusterLabels map[string]string) *clusterv1.ManagedCluster {
+	return &clusterv1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: clusterLabels}}
+}
+
+func TestGetClustersBySelectors(t *testing.T) {
+	InitAllManagedClusterNames()
+	defer InitAllManagedClusterNames()
+	updateManagedClusterLabels(newLabeledManagedCluster("c1", map[string]string{"env": "prod", "region": "eu"}))
+	updateManagedClusterLabels(newLabeledManagedCluster("c2", map[string]string{"env": "prod", "region": "us"}))
+	updateManagedClusterLabels(newLabeledManagedCluster("c3", map[string]string{"env": "dev", "region": "eu"}))
+	updateManagedClusterLabels(newLabeledManagedCluster("c4", nil))
+
+	testCaseList := []struct {
+		name      string
+		selectors []string
+		expected  []string
+	}{
+		{"no selector", nil, nil},
+		{"equality selector", []string{"env=prod,region=eu"}, []string{"c1"}},
+		{"set selector", []string{"region in (eu,us),env!=dev"}, []string{"c1", "c2"}},
+		{"existence selector", []string{"!env"}, []string{"c4"}},
+		{"any selector", []string{"env=dev", "region=us"}, []string{"c2", "c3"}},
+		{"no matched cluster", []string{"env=test"}, []string{}},
+	}
+
+	for _, c := range testCaseList {
+		var selectors []labels.Selector
+		for _, s := range c.selectors {
+			selector, err := labels.Parse(s)
+			if err != nil {
+				t.Fatalf("failed to parse selector %s: %v", s, err)
+			}
+			selectors = append(selectors, selector)
+		}
+		if output := getClustersBySelectors(selectors); !reflect.DeepEqual(output, c.expected) {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+	}
+
+	// the clusters follow the changes of their labels
+	updateManagedClusterLabels(newLabeledManagedCluster("c3", map[string]string{"env": "prod", "region": "eu"}))
+	selector, _ := labels.Parse("env=prod,region=eu")
+	expected := []string{"c1", "c3"}
+	if output := getClustersBySelectors([]labels.Selector{selector}); !reflect.DeepEqual(output, expected) {
+		t.Errorf("case (changed labels) output: (%v) is not the expected: (%v)", output, expected)
+	}
+}
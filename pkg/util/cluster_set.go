@@ -0,0 +1,96 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"sort"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/klog"
+
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+// clusterSetLabel is the label of the managed clusters with the name of their ManagedClusterSet
+const clusterSetLabel = "cluster.open-cluster-management.io/clusterset"
+
+// managedClusterSets maps the managed clusters to their ManagedClusterSet, it is guarded by mapMutex
+var managedClusterSets = map[string]string{}
+
+var clusterSetReviewer *AccessReviewer
+
+// SetClusterSetReviewer is used to grant the users who can get a ManagedClusterSet access to all
+// member clusters of the set, the access is reviewed by the reviewer. nil is used to disable it
+func SetClusterSetReviewer(reviewer *AccessReviewer) {
+	clusterSetReviewer = reviewer
+}
+
+// updateManagedClusterSet saves the ManagedClusterSet of the managed cluster, the caller must hold mapMutex
+func updateManagedClusterSet(cluster *clusterv1.ManagedCluster) {
+	clusterSet, ok := cluster.Labels[clusterSetLabel]
+	if !ok || clusterSet == "" {
+		delete(managedClusterSets, cluster.Name)
+		return
+	}
+	if managedClusterSets[cluster.Name] != clusterSet {
+		klog.Infof("managedcluster %s is in managedclusterset %s", cluster.Name, clusterSet)
+	}
+	managedClusterSets[cluster.Name] = clusterSet
+}
+
+// getClusterSetMembers returns the sorted member clusters of each ManagedClusterSet
+func getClusterSetMembers() map[string][]string {
+	mapMutex.RLock()
+	members := map[string][]string{}
+	for clusterName, clusterSet := range managedClusterSets {
+		members[clusterSet] = append(members[clusterSet], clusterName)
+	}
+	mapMutex.RUnlock()
+
+	for _, clusterList := range members {
+		sort.Strings(clusterList)
+	}
+	return members
+}
+
+// addClusterSetClusters adds the member clusters of the ManagedClusterSets which can be got by the user of the
+// token or the impersonated user to the cluster list, the cluster list is returned as is when the review fails
+func addClusterSetClusters(userName, token string, imp *Impersonation, clusterList []string) []string {
+	if clusterSetReviewer == nil {
+		return clusterList
+	}
+	members := getClusterSetMembers()
+	if len(members) == 0 {
+		return clusterList
+	}
+
+	clusterSets := make([]string, 0, len(members))
+	for clusterSet := range members {
+		clusterSets = append(clusterSets, clusterSet)
+	}
+	sort.Strings(clusterSets)
+
+	attrsList := make([]authorizationv1.ResourceAttributes, len(clusterSets))
+	for idx, clusterSet := range clusterSets {
+		attrsList[idx] = authorizationv1.ResourceAttributes{
+			Verb:     "get",
+			Group:    clusterAPIGroup,
+			Resource: "managedclustersets",
+			Name:     clusterSet,
+		}
+	}
+	allowed, err := clusterSetReviewer.Review(token, imp, attrsList)
+	if err != nil {
+		klog.Errorf("failed to review the clusterset access of user <%s>: %v", userName, err)
+		return clusterList
+	}
+
+	for idx, name := range clusterSets {
+		if allowed[idx] {
+			klog.V(1).Infof("user <%s> can access managedclusterset %s", userName, name)
+			clusterList = mergeLists(clusterList, members[name])
+		}
+	}
+	return clusterList
+}
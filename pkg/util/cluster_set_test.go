@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"reflect"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+func newManagedCluster(name, clusterSet string) *clusterv1.ManagedCluster {
+	cluster := &clusterv1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if clusterSet != "" {
+		cluster.Labels = map[string]string{clusterSetLabel: clusterSet}
+	}
+	return cluster
+}
+
+func TestUpdateManagedClusterSet(t *testing.T) {
+	InitAllManagedClusterNames()
+	updateManagedClusterSet(newManagedCluster("c1", "set1"))
+	updateManagedClusterSet(newManagedCluster("c2", "set1"))
+	updateManagedClusterSet(newManagedCluster("c3", "set2"))
+	updateManagedClusterSet(newManagedCluster("c4", ""))
+	expected := map[string][]string{"set1": {"c1", "c2"}, "set2": {"c3"}}
+	if output := getClusterSetMembers(); !reflect.DeepEqual(output, expected) {
+		t.Errorf("output: (%v) is not the expected: (%v)", output, expected)
+	}
+
+	// the clusters are moved between the sets
+	updateManagedClusterSet(newManagedCluster("c1", "set2"))
+	updateManagedClusterSet(newManagedCluster("c2", ""))
+	expected = map[string][]string{"set2": {"c1", "c3"}}
+	if output := getClusterSetMembers(); !reflect.DeepEqual(output, expected) {
+		t.Errorf("output: (%v) is not the expected: (%v)", output, expected)
+	}
+}
+
+func TestAddClusterSetClusters(t *testing.T) {
+	InitAllManagedClusterNames()
+	defer InitAllManagedClusterNames()
+	defer SetClusterSetReviewer(nil)
+	updateManagedClusterSet(newManagedCluster("c1", "set1"))
+	updateManagedClusterSet(newManagedCluster("c2", "set1"))
+	updateManagedClusterSet(newManagedCluster("c3", "set2"))
+
+	var reviews int64
+	reviewer := newFakeAccessReviewer(func(token string, attrs *authorizationv1.ResourceAttributes) (bool, error) {
+		return attrs.Resource == "managedclustersets" && attrs.Verb == "get" && attrs.Name == "set1", nil
+	}, &reviews)
+	testCaseList := []struct {
+		name        string
+		reviewer    *AccessReviewer
+		clusterList []string
+		expected    []string
+	}{
+		{"without clusterset access", nil, []string{"c3"}, []string{"c3"}},
+		{"with clusterset access", reviewer, []string{"c3"}, []string{"c3", "c1", "c2"}},
+		{"with member cluster access", reviewer, []string{"c2"}, []string{"c2", "c1"}},
+	}
+
+	for _, c := range testCaseList {
+		SetClusterSetReviewer(c.reviewer)
+		output := addClusterSetClusters("test", "user", nil, c.clusterList)
+		if !reflect.DeepEqual(output, c.expected) {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+	}
+}
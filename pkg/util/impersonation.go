@@ -0,0 +1,153 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	userv1 "github.com/openshift/api/user/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+const (
+	// ImpersonateUserHeader is the header of the user impersonated by an admin
+	ImpersonateUserHeader = "Impersonate-User"
+	// ImpersonateGroupHeader is the header of the groups impersonated by an admin, it can be repeated
+	ImpersonateGroupHeader = "Impersonate-Group"
+)
+
+var impersonationReviewer *AccessReviewer
+
+// Impersonation is the user and groups impersonated by an admin to troubleshoot their access
+type Impersonation struct {
+	UserName string
+	Groups   []string
+}
+
+// SetImpersonationReviewer is used to allow the admins to impersonate the users with the Impersonate-User and
+// Impersonate-Group headers, the impersonate verb is reviewed by the reviewer. nil is used to disable it
+func SetImpersonationReviewer(reviewer *AccessReviewer) {
+	impersonationReviewer = reviewer
+}
+
+// GetImpersonation returns the user and groups of the impersonation headers, nil is returned without Impersonate-User
+func GetImpersonation(req *http.Request) *Impersonation {
+	userName := req.Header.Get(ImpersonateUserHeader)
+	if userName == "" {
+		return nil
+	}
+	groups := []string{}
+	for _, group := range req.Header.Values(ImpersonateGroupHeader) {
+		if group != "" && !Contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	return &Impersonation{UserName: userName, Groups: groups}
+}
+
+// SetImpersonation replaces the impersonation headers with the user and groups of the impersonation
+func SetImpersonation(req *http.Request, imp *Impersonation) {
+	RemoveImpersonation(req)
+	req.Header.Set(ImpersonateUserHeader, imp.UserName)
+	for _, group := range imp.Groups {
+		req.Header.Add(ImpersonateGroupHeader, group)
+	}
+}
+
+// ResolveImpersonatedGroups adds the OpenShift groups of the impersonated user listed from the url when the
+// impersonation has no groups, so that the group-based access is the same as the access of the user. Unlike
+// the api server, which only uses the groups of the headers, the groups are resolved since the impersonation
+// is used to troubleshoot the access of the user. The groups are listed with the token of the admin
+func ResolveImpersonatedGroups(token string, imp *Impersonation, url string) error {
+	if len(imp.Groups) > 0 {
+		return nil
+	}
+
+	resp, err := sendHTTPRequest(url, "GET", token)
+	if err != nil {
+		return fmt.Errorf("failed to list the groups of the impersonated user, Impersonate-Group is required: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to list the groups of the impersonated user, Impersonate-Group is required: %v",
+			resp.Status)
+	}
+
+	groupList := userv1.GroupList{}
+	if err := json.NewDecoder(resp.Body).Decode(&groupList); err != nil {
+		return fmt.Errorf("failed to decode the groups of the impersonated user: %v", err)
+	}
+	for _, group := range groupList.Items {
+		if Contains([]string(group.Users), imp.UserName) && !Contains(imp.Groups, group.Name) {
+			imp.Groups = append(imp.Groups, group.Name)
+		}
+	}
+	return nil
+}
+
+// RemoveImpersonation removes the impersonation headers, so that they are not sent to upstream
+func RemoveImpersonation(req *http.Request) {
+	req.Header.Del(ImpersonateUserHeader)
+	req.Header.Del(ImpersonateGroupHeader)
+}
+
+// AuthorizeImpersonation checks whether the user of the token can impersonate the user and all the groups,
+// like the api server, the service accounts are reviewed as the serviceaccounts resource in their namespace
+func AuthorizeImpersonation(token string, imp *Impersonation) error {
+	if impersonationReviewer == nil {
+		return errors.New("impersonation is not enabled")
+	}
+
+	attrsList := []authorizationv1.ResourceAttributes{impersonateUserAttributes(imp.UserName)}
+	for _, group := range imp.Groups {
+		attrsList = append(attrsList, authorizationv1.ResourceAttributes{
+			Verb:     "impersonate",
+			Resource: "groups",
+			Name:     group,
+		})
+	}
+	allowed, err := impersonationReviewer.Review(token, nil, attrsList)
+	if err != nil {
+		return fmt.Errorf("failed to review impersonation: %v", err)
+	}
+	for idx, attrs := range attrsList {
+		if !allowed[idx] {
+			return fmt.Errorf("not allowed to impersonate %s %s", attrs.Resource, attrs.Name)
+		}
+	}
+	return nil
+}
+
+func impersonateUserAttributes(userName string) authorizationv1.ResourceAttributes {
+	const serviceAccountPrefix = "system:serviceaccount:"
+	if strings.HasPrefix(userName, serviceAccountPrefix) {
+		parts := strings.SplitN(strings.TrimPrefix(userName, serviceAccountPrefix), ":", 2)
+		if len(parts) == 2 {
+			return authorizationv1.ResourceAttributes{
+				Verb:      "impersonate",
+				Resource:  "serviceaccounts",
+				Namespace: parts[0],
+				Name:      parts[1],
+			}
+		}
+	}
+	return authorizationv1.ResourceAttributes{
+		Verb:     "impersonate",
+		Resource: "users",
+		Name:     userName,
+	}
+}
+
+// cacheKey returns the token of the decisions and projects cached for the token, the impersonations
+// of the same token are cached separately. Like the token, it is only kept as its keyed hash
+func (imp *Impersonation) cacheKey(token string) string {
+	if imp == nil {
+		return token
+	}
+	return token + "\n" + imp.UserName + "\n" + strings.Join(imp.Groups, ",")
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	projectv1 "github.com/openshift/api/project/v1"
+	userv1 "github.com/openshift/api/user/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetImpersonation(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:3002/api/v1/query?query=foo", nil)
+	if output := GetImpersonation(req); output != nil {
+		t.Errorf("case (no impersonation) output: (%v) is not the expected: (nil)", output)
+	}
+
+	req.Header.Set("Impersonate-User", "alice")
+	req.Header.Add("Impersonate-Group", "team-a")
+	req.Header.Add("Impersonate-Group", "team-b")
+	req.Header.Add("Impersonate-Group", "team-a")
+	expected := &Impersonation{UserName: "alice", Groups: []string{"team-a", "team-b"}}
+	if output := GetImpersonation(req); !reflect.DeepEqual(output, expected) {
+		t.Errorf("case (impersonation) output: (%v) is not the expected: (%v)", output, expected)
+	}
+
+	RemoveImpersonation(req)
+	if output := GetImpersonation(req); output != nil || len(req.Header.Values("Impersonate-Group")) != 0 {
+		t.Errorf("case (removed impersonation) output: (%v) is not the expected: (nil)", output)
+	}
+}
+
+func TestAuthorizeImpersonation(t *testing.T) {
+	defer SetImpersonationReviewer(nil)
+	if err := AuthorizeImpersonation("admin", &Impersonation{UserName: "alice"}); err == nil {
+		t.Errorf("case (disabled impersonation) should return error")
+	}
+
+	var reviews int64
+	SetImpersonationReviewer(newFakeAccessReviewer(func(token string, attrs *authorizationv1.ResourceAttributes) (bool, error) {
+		if token != "admin" || attrs.Verb != "impersonate" {
+			return false, nil
+		}
+		switch attrs.Resource {
+		case "users":
+			return attrs.Name == "alice", nil
+		case "groups":
+			return attrs.Name == "team-a", nil
+		case "serviceaccounts":
+			return attrs.Namespace == "monitoring" && attrs.Name == "dashboards", nil
+		}
+		return false, nil
+	}, &reviews))
+
+	testCaseList := []struct {
+		name     string
+		token    string
+		imp      *Impersonation
+		hasError bool
+	}{
+		{"user", "admin", &Impersonation{UserName: "alice"}, false},
+		{"user and group", "admin", &Impersonation{UserName: "alice", Groups: []string{"team-a"}}, false},
+		{"service account", "admin", &Impersonation{UserName: "system:serviceaccount:monitoring:dashboards"}, false},
+		{"forbidden user", "admin", &Impersonation{UserName: "bob"}, true},
+		{"forbidden group", "admin", &Impersonation{UserName: "alice", Groups: []string{"team-a", "system:masters"}}, true},
+		{"forbidden service account", "admin", &Impersonation{UserName: "system:serviceaccount:default:dashboards"}, true},
+		{"non admin", "user", &Impersonation{UserName: "alice"}, true},
+	}
+
+	for _, c := range testCaseList {
+		err := AuthorizeImpersonation(c.token, c.imp)
+		if (err != nil) != c.hasError {
+			t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, c.hasError)
+		}
+	}
+}
+
+func TestGetUserAccessWithImpersonation(t *testing.T) {
+	var reviews int64
+	defer SetAccessReviewer(nil)
+	allManagedClusterNames = map[string]string{"c1": "c1", "c2": "c2"}
+	// the token of the admin can access all clusters, alice can only access c2
+	SetAccessReviewer(newFakeAccessReviewer(func(token string, attrs *authorizationv1.ResourceAttributes) (bool, error) {
+		return token == "admin" || attrs.Name == "c2", nil
+	}, &reviews))
+
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:3002/api/v1/query?query=foo", nil)
+	req.Header.Set("X-Forwarded-User", "admin")
+	req.Header.Set("X-Forwarded-Access-Token", "admin")
+	if output := GetUserAccess(req, "http://127.0.0.1:3002/"); !output.AllClusters {
+		t.Errorf("case (admin) output: (%v) is not the expected: (%v)", output.AllClusters, true)
+	}
+
+	// the decisions of the admin token are not reused for the impersonated user
+	req.Header.Set("X-Forwarded-User", "alice")
+	req.Header.Set("Impersonate-User", "alice")
+	output := GetUserAccess(req, "http://127.0.0.1:3002/")
+	if output.AllClusters || !reflect.DeepEqual(output.Clusters, []string{"c2"}) {
+		t.Errorf("case (impersonated user) output: (%v, %v) is not the expected: (%v, %v)",
+			output.AllClusters, output.Clusters, false, []string{"c2"})
+	}
+}
+
+func TestFetchImpersonatedUserProjectList(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		projects := projectv1.ProjectList{}
+		for _, name := range append([]string{r.Header.Get("Impersonate-User")}, r.Header.Values("Impersonate-Group")...) {
+			if name != "" {
+				projects.Items = append(projects.Items, projectv1.Project{ObjectMeta: metav1.ObjectMeta{Name: name}})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(projects)
+	}))
+	defer server.Close()
+
+	testCaseList := []struct {
+		name     string
+		imp      *Impersonation
+		expected []string
+	}{
+		{"no impersonation", nil, []string{}},
+		{"impersonated user and groups", &Impersonation{UserName: "alice", Groups: []string{"team-a"}}, []string{"alice", "team-a"}},
+	}
+
+	for _, c := range testCaseList {
+		output := fetchUserProjectList("", c.imp, server.URL)
+		if !reflect.DeepEqual(output, c.expected) {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+	}
+}
+
+func TestResolveImpersonatedGroups(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/forbidden" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		groups := userv1.GroupList{Items: []userv1.Group{
+			{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}, Users: userv1.OptionalNames{"alice", "bob"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}, Users: userv1.OptionalNames{"bob"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "team-c"}, Users: userv1.OptionalNames{"alice"}},
+		}}
+		_ = json.NewEncoder(w).Encode(groups)
+	}))
+	defer server.Close()
+
+	testCaseList := []struct {
+		name     string
+		url      string
+		imp      *Impersonation
+		expected []string
+		hasError bool
+	}{
+		{"resolved groups", server.URL, &Impersonation{UserName: "alice", Groups: []string{}}, []string{"team-a", "team-c"}, false},
+		{"user without groups", server.URL, &Impersonation{UserName: "carol", Groups: []string{}}, []string{}, false},
+		{"impersonated groups", server.URL, &Impersonation{UserName: "alice", Groups: []string{"team-b"}}, []string{"team-b"}, false},
+		{"forbidden groups", server.URL + "/forbidden", &Impersonation{UserName: "alice", Groups: []string{}}, []string{}, true},
+		{"unreachable api server", "http://127.0.0.1:1", &Impersonation{UserName: "alice", Groups: []string{}}, []string{}, true},
+	}
+
+	for _, c := range testCaseList {
+		err := ResolveImpersonatedGroups("", c.imp, c.url)
+		if (err != nil) != c.hasError {
+			t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, c.hasError)
+		}
+		if !reflect.DeepEqual(c.imp.Groups, c.expected) {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, c.imp.Groups, c.expected)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:3002/api/v1/query?query=foo", nil)
+	req.Header.Set("Impersonate-User", "bob")
+	SetImpersonation(req, &Impersonation{UserName: "alice", Groups: []string{"team-a", "team-c"}})
+	expected := &Impersonation{UserName: "alice", Groups: []string{"team-a", "team-c"}}
+	if output := GetImpersonation(req); !reflect.DeepEqual(output, expected) {
+		t.Errorf("case (set impersonation) output: (%v) is not the expected: (%v)", output, expected)
+	}
+}
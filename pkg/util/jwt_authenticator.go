@@ -0,0 +1,268 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"k8s.io/klog"
+)
+
+// jwksRefreshInterval is the minimum interval to reload the JWKS from the url for the unknown key ids
+const jwksRefreshInterval = time.Minute
+
+// jwtClockSkew is the clock skew allowed when the exp, nbf and iat claims are validated
+const jwtClockSkew = jwt.DefaultLeeway
+
+// jwtAlgorithms are the supported signature algorithms, the tokens signed with the other algorithms
+// are rejected, e.g. the unsigned tokens with the none algorithm and the tokens signed with HMAC
+var jwtAlgorithms = []string{
+	string(jose.RS256), string(jose.RS384), string(jose.RS512),
+	string(jose.PS256), string(jose.PS384), string(jose.PS512),
+	string(jose.ES256), string(jose.ES384), string(jose.ES512),
+}
+
+// JWTAuthenticatorConfig is the configuration to validate the OIDC tokens locally
+type JWTAuthenticatorConfig struct {
+	// Issuer is the expected iss claim of the tokens
+	Issuer string
+	// Audience is the audience which the aud claim of the tokens must contain
+	Audience string
+	// JWKSFile is the path to the JWKS with the signing keys of the issuer
+	JWKSFile string
+	// JWKSURL is the url of the JWKS, it is used when JWKSFile is not set
+	JWKSURL string
+	// UsernameClaim is the claim of the user name, sub is used when it is not set
+	UsernameClaim string
+	// UsernamePrefix is prepended to the user names, so that they do not collide with the users of the hub
+	UsernamePrefix string
+	// GroupsClaim is the claim of the groups, the tokens have no group when it is not set
+	GroupsClaim string
+	// GroupsPrefix is prepended to the groups, so that they do not collide with the groups of the hub
+	GroupsPrefix string
+}
+
+// jwtAuthenticator validates the signature and the claims of the JWTs with the keys of the JWKS
+type jwtAuthenticator struct {
+	config JWTAuthenticatorConfig
+
+	mutex      sync.RWMutex
+	keys       map[string]jose.JSONWebKey
+	lastLoaded time.Time
+	// reloads runs the concurrent reloads of the JWKS once
+	reloads singleflight.Group
+}
+
+// NewJWTAuthenticator returns the authenticator which validates the OIDC tokens locally with the keys of the
+// JWKS, so that no request is sent to the api server. The RSA and ECDSA signatures are supported, and the
+// identity of the token is cached until the token expires
+func NewJWTAuthenticator(config JWTAuthenticatorConfig) (Authenticator, error) {
+	if config.Issuer == "" || config.Audience == "" {
+		return nil, errors.New("issuer and audience are required")
+	}
+	if config.JWKSFile == "" && config.JWKSURL == "" {
+		return nil, errors.New("jwks file or url is required")
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "sub"
+	}
+
+	a := &jwtAuthenticator{config: config}
+	if err := a.loadKeys(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *jwtAuthenticator) Authenticate(token string) (*UserInfo, error) {
+	parsed, err := jwt.ParseSigned(strings.TrimPrefix(token, "Bearer "))
+	if err != nil {
+		return nil, fmt.Errorf("token is not a jwt: %v", err)
+	}
+	if len(parsed.Headers) != 1 {
+		return nil, errors.New("token is not signed once")
+	}
+	header := parsed.Headers[0]
+	if !Contains(jwtAlgorithms, header.Algorithm) {
+		return nil, fmt.Errorf("unsupported algorithm: %s", header.Algorithm)
+	}
+	key, err := a.getKey(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if key.Algorithm != "" && key.Algorithm != header.Algorithm {
+		return nil, fmt.Errorf("algorithm %s does not match the key %q", header.Algorithm, header.KeyID)
+	}
+
+	standardClaims := jwt.Claims{}
+	claims := map[string]interface{}{}
+	if err := parsed.Claims(key.Key, &standardClaims, &claims); err != nil {
+		return nil, fmt.Errorf("invalid jwt: %v", err)
+	}
+	return a.validateClaims(standardClaims, claims, time.Now())
+}
+
+// validateClaims checks the issuer, audience and validity of the claims, and maps the claims to the user
+func (a *jwtAuthenticator) validateClaims(standardClaims jwt.Claims, claims map[string]interface{},
+	now time.Time) (*UserInfo, error) {
+	if standardClaims.Expiry == nil {
+		return nil, errors.New("no expiry found in token")
+	}
+	err := standardClaims.ValidateWithLeeway(jwt.Expected{
+		Issuer:   a.config.Issuer,
+		Audience: jwt.Audience{a.config.Audience},
+		Time:     now,
+	}, jwtClockSkew)
+	if err != nil {
+		return nil, err
+	}
+
+	userName, _ := claims[a.config.UsernameClaim].(string)
+	if userName == "" {
+		return nil, fmt.Errorf("no user name found in claim %s", a.config.UsernameClaim)
+	}
+	groups := []string{}
+	if a.config.GroupsClaim != "" && claims[a.config.GroupsClaim] != nil {
+		claimGroups, ok := claimStrings(claims[a.config.GroupsClaim])
+		if !ok {
+			return nil, fmt.Errorf("invalid groups in claim %s", a.config.GroupsClaim)
+		}
+		for _, group := range claimGroups {
+			groups = append(groups, a.config.GroupsPrefix+group)
+		}
+	}
+	return &UserInfo{Name: a.config.UsernamePrefix + userName, Groups: groups,
+		Expiry: standardClaims.Expiry.Time()}, nil
+}
+
+// getKey returns the key of the key id, the JWKS of the url is reloaded for the unknown key ids,
+// e.g. after the keys of the issuer are rotated. The concurrent requests share the same reload
+func (a *jwtAuthenticator) getKey(kid string) (jose.JSONWebKey, error) {
+	a.mutex.RLock()
+	key, ok := a.keys[kid]
+	reloadable := a.config.JWKSFile == "" && time.Since(a.lastLoaded) > jwksRefreshInterval
+	a.mutex.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if !reloadable {
+		return key, fmt.Errorf("no key found for key id %q", kid)
+	}
+
+	_, err, _ := a.reloads.Do("jwks", func() (interface{}, error) {
+		// the jwks may be reloaded by the other requests since the key id is not found
+		a.mutex.RLock()
+		_, ok := a.keys[kid]
+		reloaded := time.Since(a.lastLoaded) <= jwksRefreshInterval
+		a.mutex.RUnlock()
+		if ok || reloaded {
+			return nil, nil
+		}
+		klog.Infof("reload jwks for unknown key id %q", kid)
+		return nil, a.loadKeys()
+	})
+	if err != nil {
+		return key, err
+	}
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	return key, fmt.Errorf("no key found for key id %q", kid)
+}
+
+func (a *jwtAuthenticator) loadKeys() error {
+	data, err := a.readJWKS()
+	if err != nil {
+		return err
+	}
+	// the keys are decoded one by one, so that the unsupported keys are skipped
+	keySet := struct {
+		Keys []json.RawMessage `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &keySet); err != nil {
+		return fmt.Errorf("failed to decode jwks: %v", err)
+	}
+
+	keys := map[string]jose.JSONWebKey{}
+	for _, rawKey := range keySet.Keys {
+		key := jose.JSONWebKey{}
+		if err := key.UnmarshalJSON(rawKey); err != nil {
+			klog.Warningf("skip the key of jwks: %v", err)
+			continue
+		}
+		if (key.Use != "" && key.Use != "sig") || !key.IsPublic() || !key.Valid() {
+			klog.Warningf("skip the key %q of jwks which is not a public signing key", key.KeyID)
+			continue
+		}
+		keys[key.KeyID] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("no signing key found in jwks")
+	}
+
+	a.mutex.Lock()
+	a.keys = keys
+	a.lastLoaded = time.Now()
+	a.mutex.Unlock()
+	klog.Infof("loaded %v keys from jwks", len(keys))
+	return nil
+}
+
+func (a *jwtAuthenticator) readJWKS() ([]byte, error) {
+	if a.config.JWKSFile != "" {
+		data, err := ioutil.ReadFile(filepath.Clean(a.config.JWKSFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read jwks file: %v", err)
+		}
+		return data, nil
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(a.config.JWKSURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get jwks: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get jwks: %v", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwks: %v", err)
+	}
+	return data, nil
+}
+
+// claimStrings returns the values of the claim which is a string or an array of strings
+func claimStrings(claim interface{}) ([]string, bool) {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}, true
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, false
+			}
+			values = append(values, s)
+		}
+		return values, true
+	default:
+		return nil, false
+	}
+}
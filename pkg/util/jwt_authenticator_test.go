@@ -0,0 +1,320 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+type testSigner struct {
+	kid    string
+	alg    string
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func newTestSigners(t *testing.T) (*testSigner, *testSigner) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ec key: %v", err)
+	}
+	return &testSigner{kid: "rsa-key", alg: "RS256", rsaKey: rsaKey}, &testSigner{kid: "ec-key", alg: "ES256", ecKey: ecKey}
+}
+
+func (s *testSigner) jwk() jose.JSONWebKey {
+	if s.rsaKey != nil {
+		return jose.JSONWebKey{Key: &s.rsaKey.PublicKey, KeyID: s.kid, Use: "sig"}
+	}
+	return jose.JSONWebKey{Key: &s.ecKey.PublicKey, KeyID: s.kid}
+}
+
+func (s *testSigner) sign(t *testing.T, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("failed to marshal: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": s.alg, "kid": s.kid}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	if s.rsaKey != nil {
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, s.rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("failed to sign: %v", err)
+		}
+	} else {
+		r, ss, err := ecdsa.Sign(rand.Reader, s.ecKey, digest[:])
+		if err != nil {
+			t.Fatalf("failed to sign: %v", err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		ss.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeJWKS(t *testing.T, file string, signers ...*testSigner) {
+	keySet := jose.JSONWebKeySet{}
+	for _, s := range signers {
+		keySet.Keys = append(keySet.Keys, s.jwk())
+	}
+	data, _ := json.Marshal(keySet)
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	rsaSigner, ecSigner := newTestSigners(t)
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, file, rsaSigner, ecSigner)
+
+	authenticator, err := NewJWTAuthenticator(JWTAuthenticatorConfig{
+		Issuer:        "https://issuer.example.com",
+		Audience:      "rbac-query-proxy",
+		JWKSFile:      file,
+		UsernameClaim: "email",
+		GroupsClaim:   "groups",
+	})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	newClaims := func(overrides map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"iss":    "https://issuer.example.com",
+			"aud":    []string{"other", "rbac-query-proxy"},
+			"exp":    exp,
+			"email":  "alice@example.com",
+			"groups": []string{"team-a"},
+		}
+		for key, value := range overrides {
+			if value == nil {
+				delete(claims, key)
+				continue
+			}
+			claims[key] = value
+		}
+		return claims
+	}
+	expected := &UserInfo{Name: "alice@example.com", Groups: []string{"team-a"}, Expiry: time.Unix(exp, 0)}
+	tampered := rsaSigner.sign(t, newClaims(nil))
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+	unknownSigner, _ := newTestSigners(t)
+	unknownSigner.kid = "unknown"
+	unsigned := rsaSigner.sign(t, newClaims(nil))
+	unsigned = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa-key"}`)) +
+		unsigned[strings.Index(unsigned, "."):strings.LastIndex(unsigned, ".")+1]
+	skewed := time.Now().Add(-30 * time.Second).Unix()
+
+	testCaseList := []struct {
+		name     string
+		token    string
+		expected *UserInfo
+	}{
+		{"rs256 token", rsaSigner.sign(t, newClaims(nil)), expected},
+		{"es256 token with bearer prefix", "Bearer " + ecSigner.sign(t, newClaims(nil)), expected},
+		{"string audience", rsaSigner.sign(t, newClaims(map[string]interface{}{"aud": "rbac-query-proxy"})), expected},
+		{"no groups", rsaSigner.sign(t, newClaims(map[string]interface{}{"groups": nil})),
+			&UserInfo{Name: "alice@example.com", Groups: []string{}, Expiry: time.Unix(exp, 0)}},
+		{"wrong issuer", rsaSigner.sign(t, newClaims(map[string]interface{}{"iss": "https://other.example.com"})), nil},
+		{"wrong audience", rsaSigner.sign(t, newClaims(map[string]interface{}{"aud": "other"})), nil},
+		{"expired token", rsaSigner.sign(t, newClaims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})), nil},
+		{"no expiry", rsaSigner.sign(t, newClaims(map[string]interface{}{"exp": nil})), nil},
+		{"not valid yet", rsaSigner.sign(t, newClaims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})), nil},
+		{"not valid yet within clock skew", rsaSigner.sign(t, newClaims(map[string]interface{}{"nbf": time.Now().Add(30 * time.Second).Unix()})), expected},
+		{"expired within clock skew", rsaSigner.sign(t, newClaims(map[string]interface{}{"exp": skewed})),
+			&UserInfo{Name: "alice@example.com", Groups: []string{"team-a"}, Expiry: time.Unix(skewed, 0)}},
+		{"issued in the future", rsaSigner.sign(t, newClaims(map[string]interface{}{"iat": time.Now().Add(time.Hour).Unix()})), nil},
+		{"issued in the past", rsaSigner.sign(t, newClaims(map[string]interface{}{"iat": time.Now().Add(-time.Hour).Unix()})), expected},
+		{"no user name", rsaSigner.sign(t, newClaims(map[string]interface{}{"email": nil})), nil},
+		{"invalid groups", rsaSigner.sign(t, newClaims(map[string]interface{}{"groups": []int{1}})), nil},
+		{"tampered signature", tampered, nil},
+		{"unknown key", unknownSigner.sign(t, newClaims(nil)), nil},
+		{"algorithm of other key", (&testSigner{kid: "ec-key", alg: "RS256", rsaKey: rsaSigner.rsaKey}).sign(t, newClaims(nil)), nil},
+		{"no algorithm", (&testSigner{kid: "rsa-key", alg: "none", rsaKey: rsaSigner.rsaKey}).sign(t, newClaims(nil)), nil},
+		{"unsigned token", unsigned, nil},
+		{"hmac algorithm", (&testSigner{kid: "rsa-key", alg: "HS256", rsaKey: rsaSigner.rsaKey}).sign(t, newClaims(nil)), nil},
+		{"not a jwt", "sha256~token", nil},
+	}
+
+	for _, c := range testCaseList {
+		output, err := authenticator.Authenticate(c.token)
+		if (err != nil) != (c.expected == nil) {
+			t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, c.expected == nil)
+			continue
+		}
+		if !reflect.DeepEqual(output, c.expected) {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+	}
+}
+
+func TestNewJWTAuthenticator(t *testing.T) {
+	rsaSigner, _ := newTestSigners(t)
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, file, rsaSigner)
+	emptyFile := filepath.Join(dir, "empty.json")
+	writeJWKS(t, emptyFile)
+
+	testCaseList := []struct {
+		name     string
+		config   JWTAuthenticatorConfig
+		hasError bool
+	}{
+		{"jwks file", JWTAuthenticatorConfig{Issuer: "i", Audience: "a", JWKSFile: file}, false},
+		{"no issuer", JWTAuthenticatorConfig{Audience: "a", JWKSFile: file}, true},
+		{"no jwks", JWTAuthenticatorConfig{Issuer: "i", Audience: "a"}, true},
+		{"missing jwks file", JWTAuthenticatorConfig{Issuer: "i", Audience: "a", JWKSFile: filepath.Join(dir, "missing.json")}, true},
+		{"no key in jwks", JWTAuthenticatorConfig{Issuer: "i", Audience: "a", JWKSFile: emptyFile}, true},
+	}
+
+	for _, c := range testCaseList {
+		_, err := NewJWTAuthenticator(c.config)
+		if (err != nil) != c.hasError {
+			t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, c.hasError)
+		}
+	}
+}
+
+func TestJWTAuthenticatorWithJWKSURL(t *testing.T) {
+	rsaSigner, ecSigner := newTestSigners(t)
+	var signersMutex sync.Mutex
+	signers := []*testSigner{rsaSigner}
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		// the slow response lets the concurrent requests of the unknown key id wait for the same reload
+		time.Sleep(50 * time.Millisecond)
+		keySet := jose.JSONWebKeySet{}
+		signersMutex.Lock()
+		for _, s := range signers {
+			keySet.Keys = append(keySet.Keys, s.jwk())
+		}
+		signersMutex.Unlock()
+		_ = json.NewEncoder(w).Encode(keySet)
+	}))
+	defer server.Close()
+
+	authenticator, err := NewJWTAuthenticator(JWTAuthenticatorConfig{
+		Issuer:   "https://issuer.example.com",
+		Audience: "rbac-query-proxy",
+		JWKSURL:  server.URL,
+	})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+	claims := map[string]interface{}{
+		"iss": "https://issuer.example.com",
+		"aud": "rbac-query-proxy",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"sub": "alice",
+	}
+	if user, err := authenticator.Authenticate(rsaSigner.sign(t, claims)); err != nil || user.Name != "alice" {
+		t.Errorf("case (loaded key) output: (%v, %v) is not the expected: (alice, nil)", user, err)
+	}
+
+	// the keys are rotated, the jwks is not reloaded again within the refresh interval
+	signersMutex.Lock()
+	signers = append(signers, ecSigner)
+	signersMutex.Unlock()
+	if _, err := authenticator.Authenticate(ecSigner.sign(t, claims)); err == nil || atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("case (recently loaded jwks) output: (%v, %v) is not the expected: (error, 1)", err, requests)
+	}
+
+	// the concurrent requests of the unknown key id reload the jwks once
+	jwtAuth := authenticator.(*jwtAuthenticator)
+	jwtAuth.mutex.Lock()
+	jwtAuth.lastLoaded = time.Now().Add(-2 * jwksRefreshInterval)
+	jwtAuth.mutex.Unlock()
+	token := ecSigner.sign(t, claims)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if user, err := authenticator.Authenticate(token); err != nil || user.Name != "alice" {
+				t.Errorf("case (rotated key) output: (%v, %v) is not the expected: (alice, nil)", user, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("case (rotated key) requests: (%v) is not the expected: (2)", requests)
+	}
+}
+
+func TestJWTAuthenticatorWithPrefixes(t *testing.T) {
+	rsaSigner, _ := newTestSigners(t)
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, file, rsaSigner)
+
+	authenticator, err := NewJWTAuthenticator(JWTAuthenticatorConfig{
+		Issuer:         "https://issuer.example.com",
+		Audience:       "rbac-query-proxy",
+		JWKSFile:       file,
+		UsernamePrefix: "oidc:",
+		GroupsClaim:    "groups",
+		GroupsPrefix:   "oidc:",
+	})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+	// the subjects of the tokens do not collide with the users and groups of the hub
+	user, err := authenticator.Authenticate(rsaSigner.sign(t, map[string]interface{}{
+		"iss":    "https://issuer.example.com",
+		"aud":    "rbac-query-proxy",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"sub":    "kube:admin",
+		"groups": []string{"system:masters"},
+	}))
+	if err != nil || user.Name != "oidc:kube:admin" || !reflect.DeepEqual(user.Groups, []string{"oidc:system:masters"}) {
+		t.Errorf("output: (%v, %v) is not the expected: (oidc:kube:admin [oidc:system:masters], nil)", user, err)
+	}
+}
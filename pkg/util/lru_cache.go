@@ -0,0 +1,171 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lruCacheShards is the maximum number of the shards of the lru cache, the entries of different
+// shards are written concurrently
+const lruCacheShards = 16
+
+// lruCache caches the values until their expiries, and the least recently used values are evicted
+// when the cache is full. The keys are the keyed hashes of the tokens
+type lruCache struct {
+	shards []*lruCacheShard
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// lruCacheStats are the counters of the lru cache
+type lruCacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Entries   int
+}
+
+type lruCacheShard struct {
+	mutex      sync.RWMutex
+	maxEntries int
+	entries    map[string]*list.Element
+	// lru is the list of the entries from the most recently used to the least recently used, the entries
+	// read since they were moved to the front are only moved again when they are about to be evicted
+	lru *list.List
+}
+
+type lruCacheEntry struct {
+	key    string
+	value  interface{}
+	expiry time.Time
+	// read is set to 1 when the entry is read, so that the reads only take the read lock of the shard
+	read int32
+}
+
+// newLRUCache returns the lru cache with at most maxEntries entries, the size is not limited when maxEntries is 0
+func newLRUCache(maxEntries int) *lruCache {
+	c := &lruCache{}
+	// the entries are limited for each shard, so that the shards are evicted independently. The
+	// maximum is split exactly between the shards, and every shard can hold one entry at least
+	shards := lruCacheShards
+	if maxEntries > 0 && maxEntries < shards {
+		shards = maxEntries
+	}
+	c.shards = make([]*lruCacheShard, shards)
+	for idx := range c.shards {
+		shardEntries := 0
+		if maxEntries > 0 {
+			shardEntries = maxEntries / shards
+			if idx < maxEntries%shards {
+				shardEntries++
+			}
+		}
+		c.shards[idx] = &lruCacheShard{
+			maxEntries: shardEntries,
+			entries:    map[string]*list.Element{},
+			lru:        list.New(),
+		}
+	}
+	return c
+}
+
+func (c *lruCache) shard(key string) *lruCacheShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+// get returns the cached value of the key, the expired value is not returned
+// and it is removed by cleanExpired or evicted
+func (c *lruCache) get(key string) (interface{}, bool) {
+	s := c.shard(key)
+	now := time.Now()
+
+	s.mutex.RLock()
+	element, ok := s.entries[key]
+	var value interface{}
+	if ok {
+		entry := element.Value.(*lruCacheEntry)
+		ok = !now.After(entry.expiry)
+		if ok {
+			atomic.StoreInt32(&entry.read, 1)
+			value = entry.value
+		}
+	}
+	s.mutex.RUnlock()
+
+	if ok {
+		atomic.AddInt64(&c.hits, 1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+	}
+	return value, ok
+}
+
+// set caches the value of the key until the expiry, the least recently used entry of the shard
+// is evicted when the shard is full. The entries read since they were moved to the front are
+// moved to the front again instead
+func (c *lruCache) set(key string, value interface{}, expiry time.Time) {
+	s := c.shard(key)
+	entry := &lruCacheEntry{key: key, value: value, expiry: expiry}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if element, ok := s.entries[key]; ok {
+		element.Value = entry
+		s.lru.MoveToFront(element)
+		return
+	}
+	s.entries[key] = s.lru.PushFront(entry)
+	for s.maxEntries > 0 && s.lru.Len() > s.maxEntries {
+		oldest := s.lru.Back()
+		if atomic.CompareAndSwapInt32(&oldest.Value.(*lruCacheEntry).read, 1, 0) {
+			s.lru.MoveToFront(oldest)
+			continue
+		}
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*lruCacheEntry).key)
+		atomic.AddInt64(&c.evictions, 1)
+	}
+}
+
+// cleanExpired removes the expired entries, the number of the removed entries is returned
+func (c *lruCache) cleanExpired() int {
+	now := time.Now()
+	removed := 0
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		for key, element := range s.entries {
+			if now.After(element.Value.(*lruCacheEntry).expiry) {
+				s.lru.Remove(element)
+				delete(s.entries, key)
+				removed++
+			}
+		}
+		s.mutex.Unlock()
+	}
+	return removed
+}
+
+// stats returns the counters and the number of the entries of the cache
+func (c *lruCache) stats() lruCacheStats {
+	stats := lruCacheStats{
+		Hits:      atomic.LoadInt64(&c.hits),
+		Misses:    atomic.LoadInt64(&c.misses),
+		Evictions: atomic.LoadInt64(&c.evictions),
+	}
+	for _, s := range c.shards {
+		s.mutex.RLock()
+		stats.Entries += len(s.entries)
+		s.mutex.RUnlock()
+	}
+	return stats
+}
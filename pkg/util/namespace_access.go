@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+var namespaceAccess *NamespaceAccess
+var allowSeriesWithoutNamespace bool
+
+// NamespaceAccess restricts the users to the metrics of some namespaces on the managed clusters,
+// the users which are not listed and not in any listed group keep the cluster level access
+type NamespaceAccess struct {
+	// Users maps the user name to the accessible namespaces of each managed cluster
+	Users map[string]map[string][]string `json:"users"`
+	// Groups maps the group name to the accessible namespaces of each managed cluster,
+	// the user in several listed groups can access the namespaces of all the groups
+	Groups map[string]map[string][]string `json:"groups"`
+}
+
+// LoadNamespaceAccess loads the namespace access of the users from the yaml file
+func LoadNamespaceAccess(file string) error {
+	data, err := ioutil.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return fmt.Errorf("failed to read namespace access file: %v", err)
+	}
+
+	access := &NamespaceAccess{}
+	if err := yaml.Unmarshal(data, access); err != nil {
+		return fmt.Errorf("failed to parse namespace access file: %v", err)
+	}
+	for userName, clusters := range access.Users {
+		for clusterName, namespaces := range clusters {
+			if len(namespaces) == 0 {
+				return fmt.Errorf("no namespace is specified for user <%s> on cluster %s", userName, clusterName)
+			}
+		}
+	}
+	for groupName, clusters := range access.Groups {
+		for clusterName, namespaces := range clusters {
+			if len(namespaces) == 0 {
+				return fmt.Errorf("no namespace is specified for group <%s> on cluster %s", groupName, clusterName)
+			}
+		}
+	}
+
+	klog.Infof("loaded namespace access for %v users and %v groups", len(access.Users), len(access.Groups))
+	namespaceAccess = access
+	return nil
+}
+
+// SetAllowSeriesWithoutNamespace is used to allow or deny the series without namespace label
+// for the users with namespace level access
+func SetAllowSeriesWithoutNamespace(allow bool) {
+	allowSeriesWithoutNamespace = allow
+}
+
+// getUserNamespaces returns the accessible namespaces of each cluster in the clusterList for the user
+// and its groups, false is returned when the user has cluster level access
+func getUserNamespaces(userName string, groups []string, clusterList []string) (map[string][]string, bool) {
+	if namespaceAccess == nil {
+		return nil, false
+	}
+
+	entries := []map[string][]string{}
+	if clusters, ok := namespaceAccess.Users[userName]; ok {
+		entries = append(entries, clusters)
+	}
+	for _, group := range groups {
+		if clusters, ok := namespaceAccess.Groups[group]; ok {
+			entries = append(entries, clusters)
+		}
+	}
+	if len(entries) == 0 {
+		return nil, false
+	}
+
+	namespaces := map[string][]string{}
+	for _, clusterName := range clusterList {
+		for _, clusters := range entries {
+			for _, namespace := range clusters[clusterName] {
+				if !Contains(namespaces[clusterName], namespace) {
+					namespaces[clusterName] = append(namespaces[clusterName], namespace)
+				}
+			}
+		}
+		if _, ok := namespaces[clusterName]; ok && allowSeriesWithoutNamespace {
+			namespaces[clusterName] = append(namespaces[clusterName], "")
+		}
+	}
+	return namespaces, true
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadNamespaceAccess(t *testing.T) {
+	testCaseList := []struct {
+		name     string
+		content  string
+		expected int
+		hasError bool
+	}{
+		{
+			"should load namespace access",
+			`
+users:
+  user1:
+    c1: ["ns1", "ns2"]
+  user2:
+    c2: ["ns3"]
+`,
+			2,
+			false,
+		},
+		{"invalid yaml", "users: [", 0, true},
+		{"no namespace", "users: {user1: {c1: []}}", 0, true},
+		{"no group namespace", "groups: {group1: {c1: []}}", 0, true},
+	}
+
+	dir, err := ioutil.TempDir("", "namespace-access")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range testCaseList {
+		namespaceAccess = nil
+		file := filepath.Join(dir, "access.yaml")
+		if err := ioutil.WriteFile(file, []byte(c.content), 0600); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+		err := LoadNamespaceAccess(file)
+		if (err != nil) != c.hasError {
+			t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, c.hasError)
+		}
+		if err == nil && len(namespaceAccess.Users) != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, len(namespaceAccess.Users), c.expected)
+		}
+	}
+
+	if err := LoadNamespaceAccess(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Errorf("case (missing file) should return error")
+	}
+	namespaceAccess = nil
+}
+
+func TestGetUserNamespaces(t *testing.T) {
+	testCaseList := []struct {
+		name         string
+		userName     string
+		groups       []string
+		clusterList  []string
+		allowMissing bool
+		expected     string
+		scoped       bool
+	}{
+		{"cluster level user", "user2", nil, []string{"c1"}, false, "", false},
+		{"namespace level user", "user1", nil, []string{"c1", "c2", "c3"}, false, "c1:ns1,ns2;c2:ns3;", true},
+		{"allow series without namespace", "user1", nil, []string{"c2"}, true, "c2:ns3,;", true},
+		{"no accessible cluster", "user1", nil, []string{"c3"}, false, "", true},
+		{"namespace level group", "user2", []string{"group1"}, []string{"c1", "c3"}, false, "c1:ns4,ns1;c3:ns5;", true},
+		{"user and group", "user1", []string{"group1", "group2"}, []string{"c1", "c2"}, false, "c1:ns1,ns2,ns4;c2:ns3;", true},
+	}
+
+	namespaceAccess = &NamespaceAccess{
+		Users: map[string]map[string][]string{
+			"user1": {"c1": {"ns1", "ns2"}, "c2": {"ns3"}},
+		},
+		Groups: map[string]map[string][]string{
+			"group1": {"c1": {"ns4", "ns1"}, "c3": {"ns5"}},
+		},
+	}
+	defer func() {
+		namespaceAccess = nil
+		SetAllowSeriesWithoutNamespace(false)
+	}()
+	for _, c := range testCaseList {
+		SetAllowSeriesWithoutNamespace(c.allowMissing)
+		namespaces, scoped := getUserNamespaces(c.userName, c.groups, c.clusterList)
+		output := ""
+		for _, clusterName := range c.clusterList {
+			if list, ok := namespaces[clusterName]; ok {
+				output += clusterName + ":" + strings.Join(list, ",") + ";"
+			}
+		}
+		if scoped != c.scoped || output != c.expected {
+			t.Errorf("case (%v) output: (%v, %v) is not the expected: (%v, %v)", c.name, output, scoped, c.expected, c.scoped)
+		}
+	}
+}
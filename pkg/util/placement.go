@@ -0,0 +1,184 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	clusterclientset "open-cluster-management.io/api/client/cluster/clientset/versioned"
+	clusterv1alpha1 "open-cluster-management.io/api/cluster/v1alpha1"
+)
+
+// placementDecision is the clusters selected by a PlacementDecision of a Placement
+type placementDecision struct {
+	namespace string
+	name      string
+	placement string
+	clusters  []string
+}
+
+// placementDecisions maps the namespace/name of the PlacementDecisions to their decisions
+var placementDecisions = map[string]placementDecision{}
+var placementMutex sync.RWMutex
+
+var placementReviewer *AccessReviewer
+
+// SetPlacementReviewer is used to grant the users who can get a Placement or its PlacementDecisions access
+// to the clusters selected by the decisions, the access is reviewed by the reviewer. nil is used to disable it
+func SetPlacementReviewer(reviewer *AccessReviewer) {
+	placementReviewer = reviewer
+}
+
+// WatchPlacementDecisions will watch and save the decisions of placements when create/update/delete placementdecision
+func WatchPlacementDecisions(clusterClient clusterclientset.Interface) {
+	watchlist := cache.NewListWatchFromClient(clusterClient.ClusterV1alpha1().RESTClient(), "placementdecisions",
+		v1.NamespaceAll, fields.Everything())
+	_, controller := cache.NewInformer(
+		watchlist,
+		&clusterv1alpha1.PlacementDecision{},
+		time.Second*0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				updatePlacementDecision(obj.(*clusterv1alpha1.PlacementDecision))
+			},
+
+			DeleteFunc: func(obj interface{}) {
+				decision, ok := obj.(*clusterv1alpha1.PlacementDecision)
+				if !ok {
+					tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+					if !ok {
+						return
+					}
+					if decision, ok = tombstone.Obj.(*clusterv1alpha1.PlacementDecision); !ok {
+						return
+					}
+				}
+				klog.Infof("deleted a placementdecision: %s/%s", decision.Namespace, decision.Name)
+				placementMutex.Lock()
+				delete(placementDecisions, decision.Namespace+"/"+decision.Name)
+				placementMutex.Unlock()
+			},
+
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				updatePlacementDecision(newObj.(*clusterv1alpha1.PlacementDecision))
+			},
+		},
+	)
+
+	stop := make(chan struct{})
+	go controller.Run(stop)
+	for {
+		time.Sleep(time.Second * 30)
+		placementMutex.RLock()
+		klog.V(1).Infof("found %v placementdecisions", len(placementDecisions))
+		placementMutex.RUnlock()
+	}
+}
+
+func updatePlacementDecision(decision *clusterv1alpha1.PlacementDecision) {
+	placement := decision.Labels[clusterv1alpha1.PlacementLabel]
+	if placement == "" {
+		klog.Warningf("placementdecision %s/%s has no placement label", decision.Namespace, decision.Name)
+		return
+	}
+
+	clusters := make([]string, 0, len(decision.Status.Decisions))
+	for _, d := range decision.Status.Decisions {
+		if d.ClusterName != "" {
+			clusters = append(clusters, d.ClusterName)
+		}
+	}
+	klog.Infof("placement %s/%s decided clusters: %v", decision.Namespace, placement, clusters)
+
+	placementMutex.Lock()
+	placementDecisions[decision.Namespace+"/"+decision.Name] = placementDecision{
+		namespace: decision.Namespace,
+		name:      decision.Name,
+		placement: placement,
+		clusters:  clusters,
+	}
+	placementMutex.Unlock()
+}
+
+// getPlacementDecisions returns the sorted decisions
+func getPlacementDecisions() []placementDecision {
+	placementMutex.RLock()
+	decisions := make([]placementDecision, 0, len(placementDecisions))
+	for _, decision := range placementDecisions {
+		decisions = append(decisions, decision)
+	}
+	placementMutex.RUnlock()
+
+	sort.Slice(decisions, func(i, j int) bool {
+		if decisions[i].namespace != decisions[j].namespace {
+			return decisions[i].namespace < decisions[j].namespace
+		}
+		return decisions[i].name < decisions[j].name
+	})
+	return decisions
+}
+
+// addPlacementClusters adds the managed clusters selected by the PlacementDecisions whose Placement or
+// themselves can be got by the user of the token or the impersonated user to the cluster list, the
+// cluster list is returned as is when the review fails
+func addPlacementClusters(userName, token string, imp *Impersonation, clusterList []string) []string {
+	if placementReviewer == nil {
+		return clusterList
+	}
+	decisions := getPlacementDecisions()
+	if len(decisions) == 0 {
+		return clusterList
+	}
+
+	// the placement and the decision of each PlacementDecision are reviewed,
+	// the placement with several decisions is only reviewed once
+	attrsList := make([]authorizationv1.ResourceAttributes, 0, 2*len(decisions))
+	for _, decision := range decisions {
+		attrsList = append(attrsList,
+			authorizationv1.ResourceAttributes{
+				Verb:      "get",
+				Group:     clusterAPIGroup,
+				Resource:  "placements",
+				Namespace: decision.namespace,
+				Name:      decision.placement,
+			},
+			authorizationv1.ResourceAttributes{
+				Verb:      "get",
+				Group:     clusterAPIGroup,
+				Resource:  "placementdecisions",
+				Namespace: decision.namespace,
+				Name:      decision.name,
+			})
+	}
+	allowed, err := placementReviewer.Review(token, imp, attrsList)
+	if err != nil {
+		klog.Errorf("failed to review the placement access of user <%s>: %v", userName, err)
+		return clusterList
+	}
+
+	for idx, decision := range decisions {
+		if !allowed[2*idx] && !allowed[2*idx+1] {
+			continue
+		}
+		klog.V(1).Infof("user <%s> can access placement %s/%s", userName, decision.namespace, decision.placement)
+		clusters := []string{}
+		mapMutex.RLock()
+		for _, clusterName := range decision.clusters {
+			if _, ok := allManagedClusterNames[clusterName]; ok {
+				clusters = append(clusters, clusterName)
+			}
+		}
+		mapMutex.RUnlock()
+		clusterList = mergeLists(clusterList, clusters)
+	}
+	return clusterList
+}
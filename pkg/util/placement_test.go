@@ -0,0 +1,67 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"reflect"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	clusterv1alpha1 "open-cluster-management.io/api/cluster/v1alpha1"
+)
+
+func newPlacementDecision(namespace, name, placement string, clusters ...string) *clusterv1alpha1.PlacementDecision {
+	decision := &clusterv1alpha1.PlacementDecision{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{clusterv1alpha1.PlacementLabel: placement},
+		},
+	}
+	for _, clusterName := range clusters {
+		decision.Status.Decisions = append(decision.Status.Decisions, clusterv1alpha1.ClusterDecision{ClusterName: clusterName})
+	}
+	return decision
+}
+
+func TestAddPlacementClusters(t *testing.T) {
+	defer SetPlacementReviewer(nil)
+	defer func() { placementDecisions = map[string]placementDecision{} }()
+	allManagedClusterNames = map[string]string{"c1": "c1", "c2": "c2", "c3": "c3", "c4": "c4"}
+	updatePlacementDecision(newPlacementDecision("team-a", "p1-decision-1", "p1", "c1"))
+	updatePlacementDecision(newPlacementDecision("team-a", "p1-decision-2", "p1", "c2", "c5"))
+	updatePlacementDecision(newPlacementDecision("team-b", "p2-decision-1", "p2", "c3"))
+	updatePlacementDecision(newPlacementDecision("team-b", "p3-decision-1", "p3", "c4"))
+
+	var reviews int64
+	SetPlacementReviewer(newFakeAccessReviewer(func(token string, attrs *authorizationv1.ResourceAttributes) (bool, error) {
+		switch {
+		case attrs.Resource == "placements":
+			return attrs.Namespace == "team-a" && attrs.Name == "p1", nil
+		case attrs.Resource == "placementdecisions":
+			return attrs.Namespace == "team-b" && attrs.Name == "p3-decision-1", nil
+		}
+		return false, nil
+	}, &reviews))
+
+	output := addPlacementClusters("test", "user", nil, []string{"c1"})
+	expected := []string{"c1", "c2", "c4"}
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("output: (%v) is not the expected: (%v)", output, expected)
+	}
+	// the placement p1 with two decisions is reviewed once
+	if reviews != 7 {
+		t.Errorf("reviews: (%v) is not the expected: (%v)", reviews, 7)
+	}
+
+	// the placement is rescheduled to another cluster
+	updatePlacementDecision(newPlacementDecision("team-a", "p1-decision-2", "p1", "c3"))
+	output = addPlacementClusters("test", "user", nil, []string{})
+	expected = []string{"c1", "c3", "c4"}
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("output: (%v) is not the expected: (%v)", output, expected)
+	}
+}
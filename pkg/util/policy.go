@@ -0,0 +1,404 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// PolicyModeUnion grants the clusters of the policy in addition to the clusters of the projects
+	PolicyModeUnion = "union"
+	// PolicyModeIntersection restricts the clusters of the projects to the clusters of the policy
+	PolicyModeIntersection = "intersection"
+)
+
+var accessPolicy *AccessPolicy
+var accessPolicyMutex sync.RWMutex
+var policyMode = PolicyModeUnion
+
+// metricNamePattern is the metric name of the metric rules, which can contain the * wildcard
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:*][a-zA-Z0-9_:*]*$`)
+
+// AccessPolicy grants the users, groups and service accounts access to the metrics
+// of managed clusters, which is combined with their project based access
+type AccessPolicy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule grants the subjects access to the metrics of the clusters and the clusters whose labels
+// match any of the cluster selectors, e.g. env=prod,region=eu. The access is restricted to the
+// namespaces and the metrics of the rule when they are specified
+type PolicyRule struct {
+	Name             string         `json:"name"`
+	Subjects         PolicySubjects `json:"subjects"`
+	Clusters         []string       `json:"clusters"`
+	ClusterSelectors []string       `json:"clusterSelectors"`
+	Namespaces       []string       `json:"namespaces"`
+	Metrics          MetricRules    `json:"metrics"`
+
+	// selectors are parsed from the cluster selectors when the policy is loaded
+	selectors []k8slabels.Selector
+}
+
+// PolicySubjects are the users, groups and service accounts which the rule applies to
+type PolicySubjects struct {
+	Users           []string                `json:"users"`
+	Groups          []string                `json:"groups"`
+	ServiceAccounts []ServiceAccountSubject `json:"serviceAccounts"`
+}
+
+// ServiceAccountSubject is the service account which the rule applies to
+type ServiceAccountSubject struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// MetricRules are the metric names which are allowed or denied, * matches any characters of the names,
+// e.g. node_*
+type MetricRules struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// policyGrant is the access granted by the rules which apply to a user
+type policyGrant struct {
+	clusters []string
+	// anyClusters is true when a rule without clusters and cluster selectors applies, e.g. a rule which only
+	// restricts the metrics, so that the accessible clusters are not restricted by the policy
+	anyClusters bool
+	// namespaces maps the clusters to the namespaces granted by the rules with namespaces
+	namespaces map[string][]string
+	// allowMetrics is nil when the metrics are not restricted to an allow list
+	allowMetrics []string
+	denyMetrics  []string
+}
+
+// SetPolicyMode is used to set how the policy is combined with the project based access
+func SetPolicyMode(mode string) error {
+	if mode != PolicyModeUnion && mode != PolicyModeIntersection {
+		return fmt.Errorf("unsupported policy mode: %s", mode)
+	}
+	policyMode = mode
+	return nil
+}
+
+// LoadPolicyFile loads and validates the access policy from the yaml file,
+// the current policy is kept when the file is invalid
+func LoadPolicyFile(file string) error {
+	data, err := ioutil.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return fmt.Errorf("failed to read policy file: %v", err)
+	}
+
+	policy, err := parsePolicy(data)
+	if err != nil {
+		return err
+	}
+
+	accessPolicyMutex.Lock()
+	accessPolicy = policy
+	accessPolicyMutex.Unlock()
+	klog.Infof("loaded access policy with %v rules", len(policy.Rules))
+	return nil
+}
+
+// WatchPolicyFile reloads the access policy when the content of the file is changed, the last good
+// policy is kept when the changed file is invalid. The file is polled so that the updates of the
+// mounted ConfigMaps, which replace the symlinks of the files, are detected
+func WatchPolicyFile(file string, interval time.Duration) {
+	lastData, _ := ioutil.ReadFile(filepath.Clean(file))
+	for {
+		time.Sleep(interval)
+		lastData = reloadPolicyFile(file, lastData)
+	}
+}
+
+// reloadPolicyFile reloads the access policy when the content of the file is different from the
+// last content, the content is returned to be compared in the next reload
+func reloadPolicyFile(file string, lastData []byte) []byte {
+	data, err := ioutil.ReadFile(filepath.Clean(file))
+	if err != nil {
+		klog.Errorf("failed to read policy file, keep the last policy: %v", err)
+		return lastData
+	}
+	if bytes.Equal(data, lastData) {
+		return lastData
+	}
+
+	policy, err := parsePolicy(data)
+	if err != nil {
+		klog.Errorf("failed to reload policy file, keep the last policy: %v", err)
+		return data
+	}
+	accessPolicyMutex.Lock()
+	accessPolicy = policy
+	accessPolicyMutex.Unlock()
+	klog.Infof("reloaded access policy with %v rules", len(policy.Rules))
+	return data
+}
+
+func parsePolicy(data []byte) (*AccessPolicy, error) {
+	policy := &AccessPolicy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file: %v", err)
+	}
+	for idx := range policy.Rules {
+		rule := &policy.Rules[idx]
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("invalid policy rule %v (%s): %v", idx, rule.Name, err)
+		}
+	}
+	return policy, nil
+}
+
+func (r *PolicyRule) validate() error {
+	if len(r.Subjects.Users)+len(r.Subjects.Groups)+len(r.Subjects.ServiceAccounts) == 0 {
+		return errors.New("no subject is specified")
+	}
+	for _, sa := range r.Subjects.ServiceAccounts {
+		if sa.Namespace == "" || sa.Name == "" {
+			return errors.New("namespace and name are required for service accounts")
+		}
+	}
+	if len(r.Clusters)+len(r.ClusterSelectors) == 0 && len(r.Metrics.Allow)+len(r.Metrics.Deny) == 0 {
+		return errors.New("no cluster or metric is specified")
+	}
+	if len(r.Namespaces) > 0 && len(r.Clusters)+len(r.ClusterSelectors) == 0 {
+		return errors.New("namespaces are specified without cluster")
+	}
+	for _, values := range [][]string{r.Subjects.Users, r.Subjects.Groups, r.Clusters, r.Namespaces} {
+		for _, value := range values {
+			if value == "" {
+				return errors.New("empty name is specified")
+			}
+		}
+	}
+	r.selectors = make([]k8slabels.Selector, 0, len(r.ClusterSelectors))
+	for _, clusterSelector := range r.ClusterSelectors {
+		// the empty selector would match all the clusters
+		if clusterSelector == "" {
+			return errors.New("empty cluster selector is specified")
+		}
+		selector, err := k8slabels.Parse(clusterSelector)
+		if err != nil {
+			return fmt.Errorf("invalid cluster selector %q: %v", clusterSelector, err)
+		}
+		r.selectors = append(r.selectors, selector)
+	}
+	for _, name := range append(append([]string{}, r.Metrics.Allow...), r.Metrics.Deny...) {
+		if !metricNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid metric name %q", name)
+		}
+	}
+	return nil
+}
+
+// appliesTo checks whether the rule applies to the user or any of the groups
+func (r *PolicyRule) appliesTo(userName string, groups []string) bool {
+	if Contains(r.Subjects.Users, userName) {
+		return true
+	}
+	for _, group := range groups {
+		if Contains(r.Subjects.Groups, group) {
+			return true
+		}
+	}
+	for _, sa := range r.Subjects.ServiceAccounts {
+		if userName == "system:serviceaccount:"+sa.Namespace+":"+sa.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// getPolicyGrant returns the access granted to the authenticated user by the policy, nil is returned when
+// no policy is loaded or no rule applies to the user. The cluster selectors are matched with the current
+// labels of the managed clusters, so that the granted clusters follow the changes of the labels. The
+// namespaces are only granted on the clusters which no rule grants without namespaces. The allowed
+// metrics are the union of the rules, unless any rule does not restrict them, and the denied metrics
+// are the union of the rules
+func getPolicyGrant(user *UserInfo) *policyGrant {
+	accessPolicyMutex.RLock()
+	policy := accessPolicy
+	accessPolicyMutex.RUnlock()
+	if policy == nil {
+		return nil
+	}
+
+	var grant *policyGrant
+	allowAll := false
+	// fullClusters are the clusters granted by the rules without namespaces
+	fullClusters := []string{}
+	for _, rule := range policy.Rules {
+		if !rule.appliesTo(user.Name, user.Groups) {
+			continue
+		}
+		if grant == nil {
+			grant = &policyGrant{namespaces: map[string][]string{}}
+		}
+		klog.V(1).Infof("policy rule %s applies to user <%s>", rule.Name, user.Name)
+
+		if len(rule.Clusters) == 0 && len(rule.selectors) == 0 {
+			grant.anyClusters = true
+		}
+		ruleClusters := mergeLists(append([]string{}, rule.Clusters...), getClustersBySelectors(rule.selectors))
+		grant.clusters = mergeLists(grant.clusters, ruleClusters)
+		if len(rule.Namespaces) > 0 {
+			for _, clusterName := range ruleClusters {
+				grant.namespaces[clusterName] = mergeLists(grant.namespaces[clusterName], rule.Namespaces)
+			}
+		} else {
+			fullClusters = mergeLists(fullClusters, ruleClusters)
+		}
+		if len(rule.Metrics.Allow) == 0 {
+			allowAll = true
+		}
+		grant.allowMetrics = mergeLists(grant.allowMetrics, rule.Metrics.Allow)
+		grant.denyMetrics = mergeLists(grant.denyMetrics, rule.Metrics.Deny)
+	}
+	if grant == nil {
+		return nil
+	}
+	// the access to the whole cluster takes precedence over the access to some namespaces of the cluster
+	for _, clusterName := range fullClusters {
+		delete(grant.namespaces, clusterName)
+	}
+	if allowAll {
+		grant.allowMetrics = nil
+	}
+	return grant
+}
+
+// HasPolicyGrant checks whether any rule of the policy applies to the authenticated user or its groups
+func HasPolicyGrant(user *UserInfo) bool {
+	return getPolicyGrant(user) != nil
+}
+
+// applyPolicy combines the clusters of the project based access with the clusters granted by the
+// policy. In the intersection mode, the users without policy rule cannot access any cluster, and the
+// rules without clusters and cluster selectors do not restrict the accessible clusters
+func applyPolicy(grant *policyGrant, allClusters bool, clusterList []string) (bool, []string) {
+	accessPolicyMutex.RLock()
+	loaded := accessPolicy != nil
+	accessPolicyMutex.RUnlock()
+	if !loaded {
+		return allClusters, clusterList
+	}
+
+	grantedClusters := grant.managedClusters()
+
+	if policyMode == PolicyModeUnion {
+		return allClusters, mergeLists(clusterList, grantedClusters)
+	}
+
+	if grant != nil && grant.anyClusters {
+		return allClusters, clusterList
+	}
+	if allClusters {
+		return false, grantedClusters
+	}
+	intersection := []string{}
+	for _, clusterName := range clusterList {
+		if Contains(grantedClusters, clusterName) {
+			intersection = append(intersection, clusterName)
+		}
+	}
+	return false, intersection
+}
+
+// managedClusters returns the granted clusters which are managed by the hub
+func (g *policyGrant) managedClusters() []string {
+	clusterList := []string{}
+	if g == nil {
+		return clusterList
+	}
+	mapMutex.RLock()
+	for _, clusterName := range g.clusters {
+		if _, ok := allManagedClusterNames[clusterName]; ok {
+			clusterList = append(clusterList, clusterName)
+		}
+	}
+	mapMutex.RUnlock()
+	return clusterList
+}
+
+// addNamespaces adds the namespaces granted by the rules with namespaces to the namespaces of the
+// accessible clusters. Only the scope of the clusters granted with namespaces is changed, the other
+// clusters keep their namespaces, or all the namespaces when the user has cluster level access. The
+// project clusters with cluster level access keep all the namespaces as well
+func (g *policyGrant) addNamespaces(namespaces map[string][]string, clusterList []string,
+	projectClusters []string) map[string][]string {
+	if g == nil || len(g.namespaces) == 0 {
+		return namespaces
+	}
+	projectClusterSet := make(map[string]bool, len(projectClusters))
+	for _, clusterName := range projectClusters {
+		projectClusterSet[clusterName] = true
+	}
+	scoped := map[string][]string{}
+	for clusterName, clusterNamespaces := range namespaces {
+		scoped[clusterName] = clusterNamespaces
+	}
+	for _, clusterName := range clusterList {
+		grantedNamespaces, ok := g.namespaces[clusterName]
+		if !ok || (namespaces == nil && projectClusterSet[clusterName]) {
+			if namespaces == nil {
+				scoped[clusterName] = nil
+			}
+			continue
+		}
+		scoped[clusterName] = mergeLists(scoped[clusterName], grantedNamespaces)
+		if allowSeriesWithoutNamespace {
+			scoped[clusterName] = mergeLists(scoped[clusterName], []string{""})
+		}
+	}
+	return scoped
+}
+
+// metricMatchers returns the matchers of the metric names allowed by the grant,
+// nil is returned when the metrics are not restricted
+func (g *policyGrant) metricMatchers() []*labels.Matcher {
+	var matchers []*labels.Matcher
+	if g == nil {
+		return matchers
+	}
+	if g.allowMetrics != nil {
+		matchers = append(matchers, labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName,
+			metricNamesRegex(g.allowMetrics)))
+	}
+	if len(g.denyMetrics) > 0 {
+		matchers = append(matchers, labels.MustNewMatcher(labels.MatchNotRegexp, labels.MetricName,
+			metricNamesRegex(g.denyMetrics)))
+	}
+	return matchers
+}
+
+// metricNamesRegex returns the regex which matches any of the metric names, the names are quoted
+// and only * is expanded, so that the lists of literal names are intersected with the metric names
+// of the queries
+func metricNamesRegex(names []string) string {
+	patterns := make([]string, len(names))
+	for idx, name := range names {
+		parts := strings.Split(name, "*")
+		for partIdx, part := range parts {
+			parts[partIdx] = regexp.QuoteMeta(part)
+		}
+		patterns[idx] = strings.Join(parts, ".*")
+	}
+	return strings.Join(patterns, "|")
+}
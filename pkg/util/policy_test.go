@@ -0,0 +1,433 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const testPolicy = `
+rules:
+- name: sre
+  subjects:
+    groups: ["sre"]
+  clusters: ["c1", "c2", "c9"]
+  metrics:
+    deny: ["go_*"]
+- name: dashboards
+  subjects:
+    serviceAccounts:
+    - {namespace: monitoring, name: dashboards}
+  metrics:
+    allow: ["node_*", "up"]
+- name: app2
+  subjects:
+    users: ["user2"]
+  clusters: ["c2"]
+  namespaces: ["app2"]
+`
+
+func loadTestPolicy(t *testing.T, content string) {
+	policy, err := parsePolicy([]byte(content))
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+	accessPolicy = policy
+}
+
+func TestLoadPolicyFile(t *testing.T) {
+	testCaseList := []struct {
+		name     string
+		content  string
+		expected int
+		hasError bool
+	}{
+		{"should load policy", testPolicy, 3, false},
+		{"invalid yaml", "rules: [", 0, true},
+		{"unknown field", "rules: [{name: r, subjects: {users: [u]}, cluster: [c1]}]", 0, true},
+		{"no subject", "rules: [{name: r, clusters: [c1]}]", 0, true},
+		{"no cluster or metric", "rules: [{name: r, subjects: {users: [u]}}]", 0, true},
+		{"namespaces without cluster", "rules: [{name: r, subjects: {users: [u]}, namespaces: [ns1], metrics: {allow: [up]}}]", 0, true},
+		{"incomplete service account", "rules: [{name: r, subjects: {serviceAccounts: [{name: sa}]}, clusters: [c1]}]", 0, true},
+		{"empty cluster", "rules: [{name: r, subjects: {users: [u]}, clusters: [\"\"]}]", 0, true},
+		{"cluster selector", "rules: [{name: r, subjects: {users: [u]}, clusterSelectors: [\"env=prod,region=eu\"], namespaces: [ns1]}]", 1, false},
+		{"invalid cluster selector", "rules: [{name: r, subjects: {users: [u]}, clusterSelectors: [\"env in (prod\"]}]", 0, true},
+		{"empty cluster selector", "rules: [{name: r, subjects: {users: [u]}, clusterSelectors: [\"\"]}]", 0, true},
+		{"invalid metric name", "rules: [{name: r, subjects: {users: [u]}, metrics: {deny: [\"(\"]}}]", 0, true},
+		{"metric name regex", "rules: [{name: r, subjects: {users: [u]}, metrics: {deny: [\"go_.*\"]}}]", 0, true},
+		{"metric name wildcard", "rules: [{name: r, subjects: {users: [u]}, metrics: {deny: [\"go_*\"]}}]", 1, false},
+	}
+
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range testCaseList {
+		accessPolicy = nil
+		file := filepath.Join(dir, "policy.yaml")
+		if err := ioutil.WriteFile(file, []byte(c.content), 0600); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+		err := LoadPolicyFile(file)
+		if (err != nil) != c.hasError {
+			t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, c.hasError)
+		}
+		if err == nil && len(accessPolicy.Rules) != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, len(accessPolicy.Rules), c.expected)
+		}
+	}
+
+	if err := LoadPolicyFile(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Errorf("case (missing file) should return error")
+	}
+	accessPolicy = nil
+}
+
+func TestReloadPolicyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { accessPolicy = nil }()
+
+	file := filepath.Join(dir, "policy.yaml")
+	loadTestPolicy(t, testPolicy)
+	lastData := []byte(testPolicy)
+	testCaseList := []struct {
+		name     string
+		content  string
+		expected int
+	}{
+		{"unchanged file", testPolicy, 3},
+		{"valid change", "rules: [{name: r, subjects: {users: [u]}, clusters: [c1]}]", 1},
+		{"invalid change", "rules: [", 1},
+		{"valid change after invalid change", testPolicy, 3},
+	}
+
+	for _, c := range testCaseList {
+		if err := ioutil.WriteFile(file, []byte(c.content), 0600); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+		lastData = reloadPolicyFile(file, lastData)
+		if len(accessPolicy.Rules) != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, len(accessPolicy.Rules), c.expected)
+		}
+	}
+
+	lastData = reloadPolicyFile(filepath.Join(dir, "missing.yaml"), lastData)
+	if len(accessPolicy.Rules) != 3 || string(lastData) != testPolicy {
+		t.Errorf("case (missing file) output: (%v) is not the expected: (%v)", len(accessPolicy.Rules), 3)
+	}
+}
+
+func TestApplyPolicy(t *testing.T) {
+	allManagedClusterNames = map[string]string{"c0": "c0", "c1": "c1", "c2": "c2", "c3": "c3"}
+	loadTestPolicy(t, testPolicy)
+	defer func() {
+		accessPolicy = nil
+		policyMode = PolicyModeUnion
+	}()
+
+	testCaseList := []struct {
+		name                string
+		mode                string
+		userName            string
+		groups              []string
+		allClusters         bool
+		clusterList         []string
+		expectedAllClusters bool
+		expected            []string
+	}{
+		{"union with group", PolicyModeUnion, "user1", []string{"sre"}, false, []string{"c0", "c1"}, false, []string{"c0", "c1", "c2"}},
+		{"union without rule", PolicyModeUnion, "user1", nil, false, []string{"c0"}, false, []string{"c0"}},
+		{"union with all clusters", PolicyModeUnion, "user1", []string{"sre"}, true, []string{"c0"}, true, []string{"c0", "c1", "c2"}},
+		{"intersection with group", PolicyModeIntersection, "user1", []string{"sre"}, false, []string{"c0", "c1"}, false, []string{"c1"}},
+		{"intersection without rule", PolicyModeIntersection, "user1", nil, false, []string{"c0"}, false, []string{}},
+		{"intersection with all clusters", PolicyModeIntersection, "user1", []string{"sre"}, true, []string{"c0"}, false, []string{"c1", "c2"}},
+		{"intersection with metric rule", PolicyModeIntersection, "system:serviceaccount:monitoring:dashboards", nil, false, []string{"c0"}, false, []string{"c0"}},
+		{"intersection with metric rule and all clusters", PolicyModeIntersection, "system:serviceaccount:monitoring:dashboards", nil, true, []string{"c0"}, true, []string{"c0"}},
+		{"intersection with metric rule and group", PolicyModeIntersection, "system:serviceaccount:monitoring:dashboards", []string{"sre"}, false, []string{"c0", "c1"}, false, []string{"c0", "c1"}},
+	}
+
+	for _, c := range testCaseList {
+		policyMode = c.mode
+		grant := getPolicyGrant(&UserInfo{Name: c.userName, Groups: c.groups})
+		allClusters, clusterList := applyPolicy(grant, c.allClusters, c.clusterList)
+		if allClusters != c.expectedAllClusters || !reflect.DeepEqual(clusterList, c.expected) {
+			t.Errorf("case (%v) output: (%v, %v) is not the expected: (%v, %v)",
+				c.name, allClusters, clusterList, c.expectedAllClusters, c.expected)
+		}
+	}
+
+	accessPolicy = nil
+	policyMode = PolicyModeIntersection
+	if allClusters, clusterList := applyPolicy(nil, true, []string{"c0"}); !allClusters || !reflect.DeepEqual(clusterList, []string{"c0"}) {
+		t.Errorf("case (no policy) output: (%v, %v) is not the expected: (%v, %v)", allClusters, clusterList, true, []string{"c0"})
+	}
+}
+
+func TestGetPolicyGrantNamespaces(t *testing.T) {
+	loadTestPolicy(t, `
+rules:
+- name: app
+  subjects:
+    users: ["user1"]
+  clusters: ["c1", "c3"]
+  namespaces: ["app"]
+- name: sre
+  subjects:
+    groups: ["sre"]
+  clusters: ["c1", "c2"]
+`)
+	defer func() { accessPolicy = nil }()
+
+	testCaseList := []struct {
+		name     string
+		groups   []string
+		expected map[string][]string
+	}{
+		{"granted namespaces", nil, map[string][]string{"c1": {"app"}, "c3": {"app"}}},
+		{"granted namespaces and clusters", []string{"sre"}, map[string][]string{"c3": {"app"}}},
+	}
+
+	for _, c := range testCaseList {
+		grant := getPolicyGrant(&UserInfo{Name: "user1", Groups: c.groups})
+		if !reflect.DeepEqual(grant.namespaces, c.expected) {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, grant.namespaces, c.expected)
+		}
+	}
+}
+
+func TestPolicyGrantAddNamespaces(t *testing.T) {
+	grant := &policyGrant{namespaces: map[string][]string{"c1": {"app"}}}
+	testCaseList := []struct {
+		name            string
+		namespaces      map[string][]string
+		clusterList     []string
+		projectClusters []string
+		expected        map[string][]string
+	}{
+		{"cluster level access", nil, []string{"c0", "c1"}, []string{"c0"}, map[string][]string{"c0": nil, "c1": {"app"}}},
+		{"project cluster", nil, []string{"c0", "c1"}, []string{"c0", "c1"}, map[string][]string{"c0": nil, "c1": nil}},
+		{
+			"namespace level access",
+			map[string][]string{"c0": {"ns0"}, "c1": {"ns1"}},
+			[]string{"c0", "c1", "c2"},
+			[]string{"c0", "c1"},
+			map[string][]string{"c0": {"ns0"}, "c1": {"ns1", "app"}},
+		},
+	}
+
+	for _, c := range testCaseList {
+		output := grant.addNamespaces(c.namespaces, c.clusterList, c.projectClusters)
+		if !reflect.DeepEqual(output, c.expected) {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+	}
+}
+
+func TestPolicyUserAccess(t *testing.T) {
+	allManagedClusterNames = map[string]string{"c0": "c0", "c1": "c1", "c2": "c2"}
+	loadTestPolicy(t, testPolicy+`- name: metric-names
+  subjects:
+    users: ["user3"]
+  metrics:
+    allow: ["up", "process_cpu_seconds_total"]
+`)
+	defer func() { accessPolicy = nil }()
+
+	testCaseList := []struct {
+		name        string
+		userName    string
+		groups      []string
+		allClusters bool
+		clusterList []string
+		query       string
+		expected    string
+	}{
+		{"denied metrics", "user1", []string{"sre"}, false, []string{"c0"}, `up`,
+			`up{cluster=~"c0|c1|c2"}`},
+		{"denied metric names", "user1", []string{"sre"}, false, []string{"c0"}, `go_goroutines + up`,
+			`{__name__!~".*",cluster=~"c0|c1|c2"} + up{cluster=~"c0|c1|c2"}`},
+		{"allowed metrics with all clusters", "system:serviceaccount:monitoring:dashboards", nil, true, []string{"c0"},
+			`sum(node_load1) / sum(kube_pod_info)`, `sum(node_load1) / sum({__name__!~".*"})`},
+		{"allowed metric names", "system:serviceaccount:monitoring:dashboards", nil, true, []string{"c0"},
+			`{__name__=~"up|process_.*"}`, `{__name__=~"node_.*|up",__name__=~"up|process_.*"}`},
+		{"allowed metrics in binary expression", "system:serviceaccount:monitoring:dashboards", nil, true, []string{"c0"},
+			`foo + up`, `{__name__!~".*"} + up`},
+		{"allowed metric names in binary expression", "user3", nil, true, []string{"c0"},
+			`foo / on(instance) up{job="node"}`, `{__name__!~".*"} / on(instance) up{job="node"}`},
+		{"granted namespaces", "user2", nil, false, []string{"c0"}, `up`,
+			`(up{cluster="c0"} or up{cluster="c2",namespace="app2"})`},
+		{"granted namespaces on project cluster", "user2", nil, false, []string{"c2"}, `up`, `up{cluster="c2"}`},
+		{"no rule", "user1", nil, true, []string{"c0"}, `up`, `up`},
+	}
+
+	for _, c := range testCaseList {
+		access := newPolicyUserAccess(&UserInfo{Name: c.userName, Groups: c.groups}, c.allClusters, c.clusterList)
+		output := c.query
+		if !access.IsUnrestricted() {
+			var err error
+			output, err = access.injectLabels(c.query)
+			if err != nil {
+				t.Errorf("case (%v) failed to inject labels: %v", c.name, err)
+				continue
+			}
+		}
+		if output != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+		if _, err := parser.ParseExpr(output); err != nil {
+			t.Errorf("case (%v) failed to parse the output (%v): %v", c.name, output, err)
+		}
+	}
+}
+
+func TestPolicyClusterSelectors(t *testing.T) {
+	InitAllManagedClusterNames()
+	defer InitAllManagedClusterNames()
+	for name, clusterLabels := range map[string]map[string]string{
+		"c1": {"env": "prod", "region": "eu"},
+		"c2": {"env": "prod", "region": "us"},
+		"c3": {"env": "dev", "region": "eu"},
+	} {
+		allManagedClusterNames[name] = name
+		updateManagedClusterLabels(newLabeledManagedCluster(name, clusterLabels))
+	}
+	loadTestPolicy(t, `
+rules:
+- name: prod-eu
+  subjects:
+    users: ["user1"]
+  clusterSelectors: ["env=prod,region=eu"]
+- name: dev
+  subjects:
+    users: ["user2"]
+  clusterSelectors: ["env=dev"]
+  namespaces: ["app"]
+`)
+	defer func() { accessPolicy = nil }()
+
+	testCaseList := []struct {
+		name               string
+		userName           string
+		expected           []string
+		expectedNamespaces map[string][]string
+	}{
+		{"selected clusters", "user1", []string{"c1"}, nil},
+		{"selected clusters with namespaces", "user2", []string{"c3"}, map[string][]string{"c3": {"app"}}},
+	}
+
+	for _, c := range testCaseList {
+		access := newPolicyUserAccess(&UserInfo{Name: c.userName}, false, []string{})
+		if !reflect.DeepEqual(access.Clusters, c.expected) || !reflect.DeepEqual(access.Namespaces, c.expectedNamespaces) {
+			t.Errorf("case (%v) output: (%v, %v) is not the expected: (%v, %v)",
+				c.name, access.Clusters, access.Namespaces, c.expected, c.expectedNamespaces)
+		}
+	}
+
+	// the granted clusters follow the changes of the cluster labels
+	mapMutex.Lock()
+	updateManagedClusterLabels(newLabeledManagedCluster("c2", map[string]string{"env": "prod", "region": "eu"}))
+	mapMutex.Unlock()
+	expected := []string{"c1", "c2"}
+	if access := newPolicyUserAccess(&UserInfo{Name: "user1"}, false, []string{}); !reflect.DeepEqual(access.Clusters, expected) {
+		t.Errorf("case (changed labels) output: (%v) is not the expected: (%v)", access.Clusters, expected)
+	}
+}
+
+func TestGetClientCertUserAccess(t *testing.T) {
+	allManagedClusterNames = map[string]string{"c0": "c0", "c1": "c1", "c2": "c2"}
+	loadTestPolicy(t, testPolicy)
+	defer func() {
+		accessPolicy = nil
+		policyMode = PolicyModeUnion
+	}()
+
+	testCaseList := []struct {
+		name     string
+		mode     string
+		userName string
+		groups   []string
+		expected []string
+	}{
+		{"union", PolicyModeUnion, "robot", []string{"sre"}, []string{"c1", "c2"}},
+		{"intersection", PolicyModeIntersection, "robot", []string{"sre"}, []string{"c1", "c2"}},
+		{"no rule", PolicyModeUnion, "robot", []string{"dev"}, []string{}},
+	}
+
+	for _, c := range testCaseList {
+		policyMode = c.mode
+		req, _ := http.NewRequest("GET", "https://127.0.0.1:3002/api/v1/query?query=foo", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: c.userName}}}}}
+		req.Header.Set("X-Forwarded-User", c.userName)
+		SetForwardedGroups(req, c.groups)
+		access := GetUserAccess(req, "http://127.0.0.1:3002/")
+		if access.AllClusters || !reflect.DeepEqual(access.Clusters, c.expected) {
+			t.Errorf("case (%v) output: (%v, %v) is not the expected: (%v, %v)",
+				c.name, access.AllClusters, access.Clusters, false, c.expected)
+		}
+	}
+}
+
+func TestPolicyAllowsSeries(t *testing.T) {
+	allManagedClusterNames = map[string]string{"c0": "c0", "c1": "c1"}
+	loadTestPolicy(t, testPolicy)
+	defer func() { accessPolicy = nil }()
+
+	access := newPolicyUserAccess(&UserInfo{Name: "user1", Groups: []string{"sre"}}, false, []string{"c0"})
+	testCaseList := []struct {
+		name     string
+		lbls     map[string]string
+		expected bool
+	}{
+		{"allowed metric", map[string]string{"__name__": "up", "cluster": "c1"}, true},
+		{"denied metric", map[string]string{"__name__": "go_goroutines", "cluster": "c1"}, false},
+		{"no metric name", map[string]string{"cluster": "c0"}, true},
+		{"inaccessible cluster", map[string]string{"__name__": "up", "cluster": "c2"}, false},
+	}
+
+	for _, c := range testCaseList {
+		if output := access.AllowsSeries(c.lbls); output != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+	}
+}
+
+func TestHasPolicyGrant(t *testing.T) {
+	loadTestPolicy(t, testPolicy)
+	defer func() { accessPolicy = nil }()
+
+	testCaseList := []struct {
+		name     string
+		userName string
+		groups   []string
+		expected bool
+	}{
+		{"user", "user2", nil, true},
+		{"group", "user1", []string{"sre"}, true},
+		{"service account", "system:serviceaccount:monitoring:dashboards", nil, true},
+		{"other service account", "system:serviceaccount:default:dashboards", nil, false},
+		{"no rule", "user1", []string{"dev"}, false},
+	}
+
+	for _, c := range testCaseList {
+		if output := HasPolicyGrant(&UserInfo{Name: c.userName, Groups: c.groups}); output != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"time"
+)
+
+// ProjectCache caches the projects of the users for each token. The entries expire after the positive ttl,
+// or after the negative ttl when the user has no project, and the least recently used entries are evicted
+// when the cache is full. The tokens are only kept as their keyed hashes
+type ProjectCache struct {
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	cache       *lruCache
+}
+
+// ProjectCacheStats are the counters of the project cache
+type ProjectCacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Entries   int
+}
+
+// NewProjectCache returns the project cache with the ttls and at most maxEntries entries, the empty
+// project lists are not cached when negativeTTL is 0, and the size is not limited when maxEntries is 0
+func NewProjectCache(positiveTTL, negativeTTL time.Duration, maxEntries int) *ProjectCache {
+	return &ProjectCache{
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+		cache:       newLRUCache(maxEntries),
+	}
+}
+
+// Get returns the cached projects of the user of the token, the expired entry is not returned
+func (c *ProjectCache) Get(token string) (UserProject, bool) {
+	value, ok := c.cache.get(tokenKey(token))
+	if !ok {
+		return UserProject{}, false
+	}
+	return value.(UserProject), true
+}
+
+// Set caches the projects of the user of the token, the least recently used entry
+// is evicted when the cache is full
+func (c *ProjectCache) Set(token string, project UserProject) {
+	ttl := c.positiveTTL
+	if len(project.ProjectList) == 0 {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.cache.set(tokenKey(token), project, time.Now().Add(ttl))
+}
+
+// CleanExpired removes the expired entries, the number of the removed entries is returned
+func (c *ProjectCache) CleanExpired() int {
+	return c.cache.cleanExpired()
+}
+
+// Stats returns the counters and the number of the entries of the cache
+func (c *ProjectCache) Stats() ProjectCacheStats {
+	return ProjectCacheStats(c.cache.stats())
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProjectCacheTTL(t *testing.T) {
+	cache := NewProjectCache(time.Hour, 50*time.Millisecond, 0)
+	cache.Set("user", NewUserProject("user", []string{"p1"}))
+	cache.Set("no-project", NewUserProject("no-project", []string{}))
+
+	if project, ok := cache.Get("user"); !ok || !reflect.DeepEqual(project.ProjectList, []string{"p1"}) {
+		t.Errorf("case (cached projects) output: (%v, %v) is not the expected: ([p1], true)", project.ProjectList, ok)
+	}
+	if _, ok := cache.Get("no-project"); !ok {
+		t.Errorf("case (cached empty projects) output: (%v) is not the expected: (true)", ok)
+	}
+
+	// the expiry is checked on read, before the expired entries are cleaned
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := cache.Get("no-project"); ok {
+		t.Errorf("case (expired empty projects) output: (%v) is not the expected: (false)", ok)
+	}
+	if _, ok := cache.Get("user"); !ok {
+		t.Errorf("case (unexpired projects) output: (%v) is not the expected: (true)", ok)
+	}
+
+	// the empty projects are not cached without negative ttl
+	cache = NewProjectCache(time.Hour, 0, 0)
+	cache.Set("no-project", NewUserProject("no-project", []string{}))
+	if _, ok := cache.Get("no-project"); ok {
+		t.Errorf("case (no negative ttl) output: (%v) is not the expected: (false)", ok)
+	}
+}
+
+func TestProjectCacheEviction(t *testing.T) {
+	cache := NewProjectCache(time.Hour, time.Hour, lruCacheShards)
+	// every shard has one entry at most, so the tokens of the same shard evict each other
+	tokens := []string{}
+	for idx := 0; len(tokens) < 3; idx++ {
+		token := "token" + strconv.Itoa(idx)
+		if len(tokens) == 0 || cache.cache.shard(tokenKey(token)) == cache.cache.shard(tokenKey(tokens[0])) {
+			tokens = append(tokens, token)
+		}
+	}
+
+	cache.Set(tokens[0], NewUserProject("user0", []string{"p0"}))
+	cache.Set(tokens[1], NewUserProject("user1", []string{"p1"}))
+	if _, ok := cache.Get(tokens[0]); ok {
+		t.Errorf("case (least recently used entry) output: (%v) is not the expected: (false)", ok)
+	}
+	if _, ok := cache.Get(tokens[1]); !ok {
+		t.Errorf("case (most recently used entry) output: (%v) is not the expected: (true)", ok)
+	}
+
+	// the updated entry does not evict any entry
+	cache.Set(tokens[1], NewUserProject("user1", []string{"p2"}))
+	expected := ProjectCacheStats{Hits: 1, Misses: 1, Evictions: 1, Entries: 1}
+	if stats := cache.Stats(); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("case (stats) output: (%v) is not the expected: (%v)", stats, expected)
+	}
+
+	cache = NewProjectCache(time.Hour, time.Hour, 2*lruCacheShards)
+	cache.Set(tokens[0], NewUserProject("user0", []string{"p0"}))
+	cache.Set(tokens[1], NewUserProject("user1", []string{"p1"}))
+	_, _ = cache.Get(tokens[0])
+	cache.Set(tokens[2], NewUserProject("user2", []string{"p2"}))
+	for idx, expected := range []bool{true, false, true} {
+		if _, ok := cache.Get(tokens[idx]); ok != expected {
+			t.Errorf("case (recently read entry %v) output: (%v) is not the expected: (%v)", idx, ok, expected)
+		}
+	}
+}
+
+func TestProjectCacheCleanExpired(t *testing.T) {
+	cache := NewProjectCache(50*time.Millisecond, time.Hour, 0)
+	cache.Set("user", NewUserProject("user", []string{"p1"}))
+	cache.Set("no-project", NewUserProject("no-project", []string{}))
+	time.Sleep(100 * time.Millisecond)
+	if removed := cache.CleanExpired(); removed != 1 {
+		t.Errorf("output: (%v) is not the expected: (%v)", removed, 1)
+	}
+	if stats := cache.Stats(); stats.Entries != 1 {
+		t.Errorf("entries: (%v) is not the expected: (%v)", stats.Entries, 1)
+	}
+}
+
+func TestProjectCacheConcurrency(t *testing.T) {
+	const workers = 8
+	const tokens = 100
+	cache := NewProjectCache(time.Hour, time.Millisecond, tokens/2)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for idx := 0; idx < 1000; idx++ {
+				token := strconv.Itoa((idx * (w + 1)) % tokens)
+				if _, ok := cache.Get(token); !ok {
+					cache.Set(token, NewUserProject("user"+token, []string{"p" + token}))
+				}
+				if idx%100 == 0 {
+					_ = cache.CleanExpired()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	stats := cache.Stats()
+	if stats.Hits+stats.Misses != workers*1000 {
+		t.Errorf("reads: (%v) is not the expected: (%v)", stats.Hits+stats.Misses, workers*1000)
+	}
+	if stats.Entries > tokens/2 {
+		t.Errorf("entries: (%v) exceed the maximum: (%v)", stats.Entries, tokens/2)
+	}
+}
+
+func TestProjectCacheMaxEntries(t *testing.T) {
+	for _, maxEntries := range []int{1, 3, lruCacheShards + 1, 100} {
+		cache := NewProjectCache(time.Hour, time.Hour, maxEntries)
+		for idx := 0; idx < 100*maxEntries; idx++ {
+			token := "token" + strconv.Itoa(idx)
+			cache.Set(token, NewUserProject("user"+strconv.Itoa(idx), []string{"p"}))
+			// the read entries are evicted as well when the shard is full of them
+			_, _ = cache.Get(token)
+		}
+		if stats := cache.Stats(); stats.Entries != maxEntries {
+			t.Errorf("case (%v) entries: (%v) is not the maximum: (%v)", maxEntries, stats.Entries, maxEntries)
+		}
+	}
+}
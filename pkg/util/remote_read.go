@@ -0,0 +1,146 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	"k8s.io/klog"
+
+	"github.com/stolostron/rbac-query-proxy/pkg/rewrite"
+)
+
+// ModifyRemoteReadRequest will add the cluster filters to every query of the snappy-compressed
+// protobuf remote read request, the request is re-encoded and the content length is updated accordingly
+func ModifyRemoteReadRequest(req *http.Request, access *UserAccess) error {
+	if access.IsUnrestricted() {
+		klog.Infof("user <%v> have access to all clusters", access.UserName)
+		return nil
+	}
+
+	readReq, err := decodeReadRequest(req)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrQueryRewrite, err)
+		rejectQuery(access.UserName, err)
+		return err
+	}
+
+	for _, query := range readReq.Queries {
+		matchers, err := rewriteReadMatchers(query.Matchers, access)
+		if err != nil {
+			rejectQuery(access.UserName, err)
+			return err
+		}
+		query.Matchers = matchers
+	}
+
+	data, err := readReq.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to marshal remote read request: %v", err)
+	}
+	setRequestBody(req, string(snappy.Encode(nil, data)))
+	return nil
+}
+
+func decodeReadRequest(req *http.Request) (*prompb.ReadRequest, error) {
+	if req.Body == nil {
+		return nil, errors.New("empty remote read request")
+	}
+	compressed, err := ioutil.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read remote read request: %v", err)
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress remote read request: %v", err)
+	}
+
+	readReq := &prompb.ReadRequest{}
+	if err := readReq.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal remote read request: %v", err)
+	}
+	return readReq, nil
+}
+
+// rewriteReadMatchers rewrites the matchers of a remote read query as the selector of a query, so that
+// they are filtered in the same way. The query which does not match any accessible cluster is kept
+// in the request with a matcher which never matches, since the results are returned in the query order
+func rewriteReadMatchers(matchers []*prompb.LabelMatcher, access *UserAccess) ([]*prompb.LabelMatcher, error) {
+	matcherStrings := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		matcher, err := fromReadMatcher(m)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrQueryRewrite, err)
+		}
+		matcherStrings = append(matcherStrings, matcher.String())
+	}
+	selector := "{" + strings.Join(matcherStrings, ",") + "}"
+
+	// the matchers of each query cannot be split into the selectors of the namespace scopes
+	modifiedSelectors, err := rewriteQueryStrings(selector, access.injectSelectorLabels)
+	if err == nil && len(modifiedSelectors) > 1 {
+		err = fmt.Errorf("%w %q: %v", ErrQueryRewrite, selector, rewrite.ErrAmbiguousScope)
+	}
+	modifiedSelector := modifiedSelectors[0]
+	if errors.Is(err, rewrite.ErrEmptyResult) {
+		klog.Infof("remote read query %v from user <%v> does not match any accessible cluster", selector, access.UserName)
+		return append(matchers, &prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "cluster", Value: ".*"}), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if modifiedSelector == selector {
+		return matchers, nil
+	}
+
+	modifiedMatchers, err := parser.ParseMetricSelector(modifiedSelector)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %v", ErrQueryRewrite, modifiedSelector, err)
+	}
+	readMatchers := make([]*prompb.LabelMatcher, 0, len(modifiedMatchers))
+	for _, m := range modifiedMatchers {
+		readMatchers = append(readMatchers, toReadMatcher(m))
+	}
+	return readMatchers, nil
+}
+
+func fromReadMatcher(m *prompb.LabelMatcher) (*labels.Matcher, error) {
+	var matchType labels.MatchType
+	switch m.Type {
+	case prompb.LabelMatcher_EQ:
+		matchType = labels.MatchEqual
+	case prompb.LabelMatcher_NEQ:
+		matchType = labels.MatchNotEqual
+	case prompb.LabelMatcher_RE:
+		matchType = labels.MatchRegexp
+	case prompb.LabelMatcher_NRE:
+		matchType = labels.MatchNotRegexp
+	default:
+		return nil, fmt.Errorf("invalid matcher type: %v", m.Type)
+	}
+	return labels.NewMatcher(matchType, m.Name, m.Value)
+}
+
+func toReadMatcher(m *labels.Matcher) *prompb.LabelMatcher {
+	matchType := prompb.LabelMatcher_EQ
+	switch m.Type {
+	case labels.MatchNotEqual:
+		matchType = prompb.LabelMatcher_NEQ
+	case labels.MatchRegexp:
+		matchType = prompb.LabelMatcher_RE
+	case labels.MatchNotRegexp:
+		matchType = prompb.LabelMatcher_NRE
+	}
+	return &prompb.LabelMatcher{Type: matchType, Name: m.Name, Value: m.Value}
+}
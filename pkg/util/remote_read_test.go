@@ -0,0 +1,132 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func newRemoteReadRequest(t *testing.T, readReq *prompb.ReadRequest) *http.Request {
+	data, err := readReq.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal remote read request: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:3002/api/v1/read", bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		t.Fatalf("failed to create remote read request: %v", err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	return req
+}
+
+func readMatchers(matchers ...string) []*prompb.LabelMatcher {
+	types := map[string]prompb.LabelMatcher_Type{
+		"=": prompb.LabelMatcher_EQ, "!=": prompb.LabelMatcher_NEQ,
+		"=~": prompb.LabelMatcher_RE, "!~": prompb.LabelMatcher_NRE,
+	}
+	readMatchers := []*prompb.LabelMatcher{}
+	for i := 0; i+2 < len(matchers); i += 3 {
+		readMatchers = append(readMatchers, &prompb.LabelMatcher{
+			Type: types[matchers[i+1]], Name: matchers[i], Value: matchers[i+2],
+		})
+	}
+	return readMatchers
+}
+
+func TestModifyRemoteReadRequest(t *testing.T) {
+	allManagedClusterNames = map[string]string{"c0": "c0", "c1": "c1", "c2": "c2"}
+	access := NewUserAccess("test", false, []string{"c0", "c1"}, nil)
+	testCaseList := []struct {
+		name     string
+		matchers []*prompb.LabelMatcher
+		expected []*prompb.LabelMatcher
+	}{
+		{
+			"metric name",
+			readMatchers("__name__", "=", "foo"),
+			readMatchers("__name__", "=", "foo", "cluster", "=~", "c0|c1"),
+		},
+		{
+			"accessible cluster",
+			readMatchers("__name__", "=", "foo", "cluster", "=", "c1"),
+			readMatchers("__name__", "=", "foo", "cluster", "=", "c1"),
+		},
+		{
+			"inaccessible cluster",
+			readMatchers("__name__", "=", "foo", "cluster", "=", "c2"),
+			readMatchers("__name__", "=", "foo", "cluster", "=", "c2", "cluster", "!~", ".*"),
+		},
+		{
+			"regex matchers",
+			readMatchers("job", "=~", "a.*", "cluster", "=~", "c1|c2"),
+			readMatchers("cluster", "=", "c1", "job", "=~", "a.*"),
+		},
+	}
+
+	for _, c := range testCaseList {
+		readReq := &prompb.ReadRequest{
+			Queries: []*prompb.Query{{StartTimestampMs: 1, EndTimestampMs: 2, Matchers: c.matchers}},
+			AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{
+				prompb.ReadRequest_STREAMED_XOR_CHUNKS,
+			},
+		}
+		req := newRemoteReadRequest(t, readReq)
+		if err := ModifyRemoteReadRequest(req, access); err != nil {
+			t.Errorf("case (%v) failed to modify remote read request: %v", c.name, err)
+			continue
+		}
+
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+			t.Errorf("case (%v) content length: (%v) is not the body length: (%v)",
+				c.name, req.Header.Get("Content-Length"), len(body))
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		modifiedReq, err := decodeReadRequest(req)
+		if err != nil {
+			t.Errorf("case (%v) failed to decode modified request: %v", c.name, err)
+			continue
+		}
+
+		query := modifiedReq.Queries[0]
+		if query.StartTimestampMs != 1 || query.EndTimestampMs != 2 ||
+			!reflect.DeepEqual(modifiedReq.AcceptedResponseTypes, readReq.AcceptedResponseTypes) {
+			t.Errorf("case (%v) output: (%v) does not keep the request fields", c.name, modifiedReq)
+		}
+		if !reflect.DeepEqual(query.Matchers, c.expected) {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, query.Matchers, c.expected)
+		}
+	}
+}
+
+func TestModifyRemoteReadRequestWithNamespaceScope(t *testing.T) {
+	access := NewUserAccess("test", false, []string{"c0", "c1"},
+		map[string][]string{"c0": {"ns1"}, "c1": {"ns2"}})
+	readReq := &prompb.ReadRequest{
+		Queries: []*prompb.Query{{StartTimestampMs: 1, EndTimestampMs: 2, Matchers: readMatchers("__name__", "=", "foo")}},
+	}
+	// the matchers of the clusters with different namespaces cannot be expressed in a single query
+	err := ModifyRemoteReadRequest(newRemoteReadRequest(t, readReq), access)
+	if !errors.Is(err, ErrQueryRewrite) {
+		t.Errorf("error: (%v) is not the expected: (%v)", err, ErrQueryRewrite)
+	}
+}
+
+func TestModifyRemoteReadRequestWithInvalidBody(t *testing.T) {
+	access := NewUserAccess("test", false, []string{"c0"}, nil)
+	req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1:3002/api/v1/read", bytes.NewReader([]byte("invalid")))
+	if err := ModifyRemoteReadRequest(req, access); !errors.Is(err, ErrQueryRewrite) {
+		t.Errorf("output: (%v) is not the expected: (%v)", err, ErrQueryRewrite)
+	}
+}
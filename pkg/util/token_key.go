@@ -0,0 +1,33 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"k8s.io/klog"
+)
+
+// tokenKeySecret is the secret of the keyed hashes of the tokens, it is generated for each process
+var tokenKeySecret = newTokenKeySecret()
+
+func newTokenKeySecret() []byte {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		klog.Fatalf("failed to generate token key secret: %v", err)
+	}
+	return secret
+}
+
+// tokenKey returns the HMAC of the token, which is used as the cache key instead of the token, so that
+// the tokens are not kept in memory. The hashes cannot be computed from the leaked tokens without the
+// secret, which is never exposed
+func tokenKey(token string) string {
+	mac := hmac.New(sha256.New, tokenKeySecret)
+	_, _ = mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenKey(t *testing.T) {
+	token := "sha256~secret-token"
+	key := tokenKey(token)
+	if key != tokenKey(token) {
+		t.Errorf("key of the same token is changed: (%v) != (%v)", key, tokenKey(token))
+	}
+	if key == tokenKey(token+"2") {
+		t.Errorf("keys of different tokens are the same: (%v)", key)
+	}
+	hash := sha256.Sum256([]byte(token))
+	if strings.Contains(key, token) || key == hex.EncodeToString(hash[:]) {
+		t.Errorf("key: (%v) can be computed without the secret", key)
+	}
+}
+
+func TestCachesDoNotKeepTokens(t *testing.T) {
+	token := "sha256~secret-token"
+	InitUserProjectInfo()
+	UpdateUserProject(token, NewUserProject("alice", []string{"p1"}))
+	if projects, ok := GetUserProjectList(token); !ok || len(projects) != 1 {
+		t.Errorf("output: (%v, %v) is not the expected: ([p1], true)", projects, ok)
+	}
+	for _, s := range getUserProjectCache().cache.shards {
+		for key := range s.entries {
+			if strings.Contains(key, token) {
+				t.Errorf("project cache keeps the token: (%v)", key)
+			}
+		}
+	}
+
+	fake := &fakeAuthenticator{users: map[string]*UserInfo{token: {Name: "alice"}}}
+	authenticator := NewCachedAuthenticator(fake, time.Minute, 0).(*cachedAuthenticator)
+	if _, err := authenticator.Authenticate(token); err != nil {
+		t.Errorf("failed to authenticate: %v", err)
+	}
+	for _, s := range authenticator.users.shards {
+		for key := range s.entries {
+			if strings.Contains(key, token) {
+				t.Errorf("identity cache keeps the token: (%v)", key)
+			}
+		}
+	}
+}
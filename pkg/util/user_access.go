@@ -0,0 +1,218 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"net/http"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"k8s.io/klog"
+
+	"github.com/stolostron/rbac-query-proxy/pkg/rewrite"
+)
+
+// UserAccess is the clusters and namespaces accessible by a user
+type UserAccess struct {
+	UserName    string
+	Groups      []string
+	AllClusters bool
+	Clusters    []string
+	// Namespaces maps the accessible clusters to the accessible namespaces, it is nil when the user
+	// has cluster level access, and the clusters mapped to nil have all the namespaces accessible
+	Namespaces map[string][]string
+
+	clusterSet map[string]bool
+	// metricMatchers restrict the metric names accessible by the user, they are granted by the policy
+	metricMatchers []*labels.Matcher
+}
+
+// NewUserAccess returns the access of the user to the clusters and namespaces
+func NewUserAccess(userName string, allClusters bool, clusters []string, namespaces map[string][]string) *UserAccess {
+	access := &UserAccess{
+		UserName:    userName,
+		AllClusters: allClusters,
+		Clusters:    clusters,
+		Namespaces:  namespaces,
+		clusterSet:  map[string]bool{},
+	}
+	for _, clusterName := range clusters {
+		access.clusterSet[clusterName] = true
+	}
+	return access
+}
+
+// GetUserAccess returns the clusters and namespaces accessible by the user of the request, the user and
+// groups are taken from the X-Forwarded-User and X-Forwarded-Groups headers, which preCheckRequest
+// replaces with the authenticated identity of the request
+func GetUserAccess(req *http.Request, url string) *UserAccess {
+	user := &UserInfo{Name: req.Header.Get("X-Forwarded-User"), Groups: GetForwardedGroups(req)}
+	token := req.Header.Get("X-Forwarded-Access-Token")
+	if token == "" {
+		if _, ok := GetClientCertUser(req); ok {
+			return getClientCertUserAccess(user)
+		}
+		klog.Errorf("failed to get token from http header")
+	}
+
+	// the impersonation headers are authorized by preCheckRequest, the projects and the access reviews
+	// are got with the token as the impersonated user
+	imp := GetImpersonation(req)
+	if accessReviewer != nil {
+		return getReviewedUserAccess(user, token, imp)
+	}
+
+	projectList, ok := GetUserProjectList(imp.cacheKey(token))
+	klog.V(1).Infof("projectList from local mem cache = %v, ok = %v", projectList, ok)
+	if !ok {
+		projectList = fetchUserProjectList(token, imp, url)
+		up := NewUserProject(user.Name, projectList)
+		UpdateUserProject(imp.cacheKey(token), up)
+		klog.V(1).Infof("projectList from api server = %v", projectList)
+	}
+
+	klog.V(1).Infof("cluster list: %v", allManagedClusterNames)
+	klog.V(1).Infof("user <%s> project list: %v", user.Name, projectList)
+	clusterList := addClusterSetClusters(user.Name, token, imp, getUserClusterList(projectList))
+	clusterList = addPlacementClusters(user.Name, token, imp, clusterList)
+	return newPolicyUserAccess(user, canAccessAllClusters(projectList), clusterList)
+}
+
+// getReviewedUserAccess returns the access of the user decided with the access reviews of the token,
+// the user cannot access any cluster by the cluster reviews when they fail
+func getReviewedUserAccess(user *UserInfo, token string, imp *Impersonation) *UserAccess {
+	allClusters, clusterList, err := accessReviewer.AuthorizedClusters(token, imp, getAllManagedClusterList())
+	if err != nil {
+		klog.Errorf("failed to review the cluster access of user <%s>: %v", user.Name, err)
+		clusterList = []string{}
+		allClusters = false
+	}
+
+	// the clusters of the clustersets and placements are still granted when the cluster reviews fail
+	clusterList = addClusterSetClusters(user.Name, token, imp, clusterList)
+	clusterList = addPlacementClusters(user.Name, token, imp, clusterList)
+	klog.V(1).Infof("user <%s> reviewed cluster list: %v", user.Name, clusterList)
+	return newPolicyUserAccess(user, allClusters, clusterList)
+}
+
+// newPolicyUserAccess combines the clusters accessible by the user with the access granted by the policy,
+// and restricts the namespaces and the metrics of the clusters accordingly
+func newPolicyUserAccess(user *UserInfo, allClusters bool, clusterList []string) *UserAccess {
+	grant := getPolicyGrant(user)
+	// in the union mode, the clusters accessible without the policy are not scoped by the granted namespaces
+	projectClusters := []string{}
+	if policyMode == PolicyModeUnion {
+		projectClusters = clusterList
+		if allClusters {
+			projectClusters = getAllManagedClusterList()
+		}
+	}
+	allClusters, clusterList = applyPolicy(grant, allClusters, clusterList)
+	return newGrantedUserAccess(user, grant, allClusters, clusterList, projectClusters)
+}
+
+// getClientCertUserAccess returns the access of the user authenticated by the client certificate, the user
+// has no project or token to be reviewed, so the clusters are only granted by the policy in either mode
+func getClientCertUserAccess(user *UserInfo) *UserAccess {
+	grant := getPolicyGrant(user)
+	return newGrantedUserAccess(user, grant, false, grant.managedClusters(), nil)
+}
+
+// newGrantedUserAccess restricts the namespaces and the metrics of the accessible clusters of the user
+// with the namespace access and the policy grant, the project clusters keep their namespaces
+func newGrantedUserAccess(user *UserInfo, grant *policyGrant, allClusters bool, clusterList []string,
+	projectClusters []string) *UserAccess {
+	namespaces, _ := getUserNamespaces(user.Name, user.Groups, clusterList)
+	namespaces = grant.addNamespaces(namespaces, clusterList, projectClusters)
+
+	access := NewUserAccess(user.Name, allClusters, clusterList, namespaces)
+	access.Groups = user.Groups
+	access.metricMatchers = grant.metricMatchers()
+	return access
+}
+
+// IsUnrestricted checks whether the user can access all the metrics
+func (a *UserAccess) IsUnrestricted() bool {
+	return a.AllClusters && a.Namespaces == nil && len(a.metricMatchers) == 0
+}
+
+// AllowsSeries checks whether the series with the labels is accessible by the user. The series without
+// cluster label are allowed, since they are aggregated from the series of the accessible clusters. For
+// the users with namespace level access, the series without namespace label are only allowed when
+// the series without namespace are allowed
+func (a *UserAccess) AllowsSeries(lbls map[string]string) bool {
+	if a.IsUnrestricted() {
+		return true
+	}
+
+	if metricName, ok := lbls[labels.MetricName]; ok {
+		for _, m := range a.metricMatchers {
+			if !m.Matches(metricName) {
+				return false
+			}
+		}
+	}
+
+	clusterName, ok := lbls["cluster"]
+	if !ok {
+		return true
+	}
+
+	if a.Namespaces != nil {
+		namespaces, ok := a.Namespaces[clusterName]
+		if !ok {
+			return false
+		}
+		if namespaces == nil {
+			return true
+		}
+		namespace, ok := lbls["namespace"]
+		if !ok {
+			return allowSeriesWithoutNamespace
+		}
+		return Contains(namespaces, namespace)
+	}
+	return a.AllClusters || a.clusterSet[clusterName]
+}
+
+func (a *UserAccess) injectLabels(query string) (string, error) {
+	query, err := a.injectClusterLabels(query)
+	if err != nil || len(a.metricMatchers) == 0 {
+		return query, err
+	}
+	return rewrite.InjectMatchers(query, a.metricMatchers)
+}
+
+// injectSelectorLabels is like injectLabels for the selectors which cannot be joined with or, e.g. the
+// match[] selectors, the selector is split into a selector for each namespace scope of the clusters
+func (a *UserAccess) injectSelectorLabels(selector string) ([]string, error) {
+	if a.Namespaces == nil {
+		query, err := a.injectLabels(selector)
+		return []string{query}, err
+	}
+
+	selectors, err := rewrite.InjectScopedLabelsSelectors(selector, "cluster", "namespace", a.Namespaces)
+	if err != nil || len(a.metricMatchers) == 0 {
+		return selectors, err
+	}
+	for idx := range selectors {
+		if selectors[idx], err = rewrite.InjectMatchers(selectors[idx], a.metricMatchers); err != nil {
+			return nil, err
+		}
+	}
+	return selectors, nil
+}
+
+func (a *UserAccess) injectClusterLabels(query string) (string, error) {
+	if a.Namespaces != nil {
+		return rewrite.InjectScopedLabels(query, "cluster", "namespace", a.Namespaces)
+	}
+	if a.AllClusters {
+		// the user is only restricted by the metric matchers
+		return query, nil
+	}
+	if useNegativeClusterMatcher() {
+		return rewrite.InjectLabelsWithExclusion(query, "cluster", a.Clusters, getKnownClusterList())
+	}
+	return rewrite.InjectLabels(query, "cluster", a.Clusters)
+}
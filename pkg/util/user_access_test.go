@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Copyright Contributors to the Open Cluster Management project
+
+package util
+
+import (
+	"testing"
+)
+
+func TestInjectLabelsWithNegativeClusterMatcher(t *testing.T) {
+	allManagedClusterNames = map[string]string{"c0": "c0", "c1": "c1", "c2": "c2", "c3": "c3"}
+	access := NewUserAccess("test", false, []string{"c0", "c1", "c2"}, nil)
+	testCaseList := []struct {
+		name     string
+		negative bool
+		expected string
+	}{
+		{"positive cluster matcher", false, `foo{cluster=~"c0|c1|c2"}`},
+		{"negative cluster matcher", true, `foo{cluster!~"c3|"}`},
+	}
+
+	defer func() {
+		SetNegativeClusterMatcher(false)
+		upstreamClusterNames = nil
+	}()
+	// the negative cluster matcher is not used until the clusters stored upstream are loaded
+	SetNegativeClusterMatcher(true)
+	expected := `foo{cluster=~"c0|c1|c2"}`
+	if output, _ := access.injectLabels("foo"); output != expected {
+		t.Errorf("case (upstream clusters not loaded) output: (%v) is not the expected: (%v)", output, expected)
+	}
+
+	SetUpstreamClusterNames([]string{"c0", "c1", "c2", "c3"})
+	for _, c := range testCaseList {
+		SetNegativeClusterMatcher(c.negative)
+		output, err := access.injectLabels("foo")
+		if err != nil {
+			t.Errorf("case (%v) failed to inject labels: %v", c.name, err)
+		}
+		if output != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+	}
+
+	// the metrics of the clusters deleted since the proxy started are still stored upstream
+	deletedManagedClusterNames = map[string]bool{"c4": true}
+	defer func() { deletedManagedClusterNames = map[string]bool{} }()
+	expected = `foo{cluster!~"c3|c4|"}`
+	if output, _ := access.injectLabels("foo"); output != expected {
+		t.Errorf("case (deleted cluster) output: (%v) is not the expected: (%v)", output, expected)
+	}
+
+	// the clusters deleted before the proxy started are only known from upstream
+	deletedManagedClusterNames = map[string]bool{}
+	SetUpstreamClusterNames([]string{"c0", "c1", "c2", "c3", "c5"})
+	expected = `foo{cluster!~"c3|c5|"}`
+	if output, _ := access.injectLabels("foo"); output != expected {
+		t.Errorf("case (cluster deleted before start) output: (%v) is not the expected: (%v)", output, expected)
+	}
+}
+
+func TestAllowsSeries(t *testing.T) {
+	testCaseList := []struct {
+		name     string
+		access   *UserAccess
+		lbls     map[string]string
+		expected bool
+	}{
+		{"unrestricted user", NewUserAccess("u", true, []string{"c1"}, nil), map[string]string{"cluster": "c2"}, true},
+		{"accessible cluster", NewUserAccess("u", false, []string{"c1"}, nil), map[string]string{"cluster": "c1"}, true},
+		{"inaccessible cluster", NewUserAccess("u", false, []string{"c1"}, nil), map[string]string{"cluster": "c2"}, false},
+		{"no cluster label", NewUserAccess("u", false, []string{"c1"}, nil), map[string]string{"job": "j"}, true},
+		{
+			"accessible namespace",
+			NewUserAccess("u", false, []string{"c1"}, map[string][]string{"c1": {"ns1"}}),
+			map[string]string{"cluster": "c1", "namespace": "ns1"},
+			true,
+		},
+		{
+			"inaccessible namespace",
+			NewUserAccess("u", true, []string{"c1"}, map[string][]string{"c1": {"ns1"}}),
+			map[string]string{"cluster": "c1", "namespace": "ns2"},
+			false,
+		},
+		{
+			"series without namespace",
+			NewUserAccess("u", false, []string{"c1"}, map[string][]string{"c1": {"ns1"}}),
+			map[string]string{"cluster": "c1"},
+			false,
+		},
+		{
+			"cluster with all namespaces",
+			NewUserAccess("u", false, []string{"c1", "c2"}, map[string][]string{"c1": {"ns1"}, "c2": nil}),
+			map[string]string{"cluster": "c2"},
+			true,
+		},
+		{
+			"cluster without namespace access",
+			NewUserAccess("u", true, []string{"c1", "c2"}, map[string][]string{"c1": {"ns1"}}),
+			map[string]string{"cluster": "c2"},
+			false,
+		},
+	}
+
+	for _, c := range testCaseList {
+		output := c.access.AllowsSeries(c.lbls)
+		if output != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+	}
+
+	SetAllowSeriesWithoutNamespace(true)
+	defer SetAllowSeriesWithoutNamespace(false)
+	access := NewUserAccess("u", false, []string{"c1"}, map[string][]string{"c1": {"ns1", ""}})
+	if !access.AllowsSeries(map[string]string{"cluster": "c1"}) {
+		t.Errorf("case (series without namespace allowed) output: (false) is not the expected: (true)")
+	}
+}
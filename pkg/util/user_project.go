@@ -7,71 +7,129 @@ import (
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/klog"
 )
 
-var userProjectInfo *UserProjectInfo
+const (
+	defaultProjectCacheTTL         = 24 * time.Hour
+	defaultProjectCacheNegativeTTL = time.Minute
+	defaultProjectCacheMaxEntries  = 10000
+)
 
-type UserProjectInfo struct {
-	sync.RWMutex
-	ProjectInfo map[string]UserProject
-}
+var userProjectCache = NewProjectCache(defaultProjectCacheTTL, defaultProjectCacheNegativeTTL,
+	defaultProjectCacheMaxEntries)
+var projectCacheConfig = struct {
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+}{defaultProjectCacheTTL, defaultProjectCacheNegativeTTL, defaultProjectCacheMaxEntries}
+var projectCacheMutex sync.RWMutex
 
 type UserProject struct {
 	UserName    string
 	Timestamp   int64
-	Token       string
 	ProjectList []string
 }
 
+// SetProjectCacheConfig is used to set the ttls and the maximum number of entries of the project cache,
+// the projects are cached for the positive ttl, or for the negative ttl when the user has no project.
+// The cache is recreated with the config
+func SetProjectCacheConfig(positiveTTL, negativeTTL time.Duration, maxEntries int) {
+	projectCacheMutex.Lock()
+	projectCacheConfig.positiveTTL = positiveTTL
+	projectCacheConfig.negativeTTL = negativeTTL
+	projectCacheConfig.maxEntries = maxEntries
+	projectCacheMutex.Unlock()
+	InitUserProjectInfo()
+}
+
+// InitUserProjectInfo removes all the cached projects
 func InitUserProjectInfo() {
-	userProjectInfo = new(UserProjectInfo)
-	userProjectInfo.ProjectInfo = map[string]UserProject{}
+	projectCacheMutex.Lock()
+	userProjectCache = NewProjectCache(projectCacheConfig.positiveTTL, projectCacheConfig.negativeTTL,
+		projectCacheConfig.maxEntries)
+	projectCacheMutex.Unlock()
 }
 
-func NewUserProject(userName string, token string, projects []string) UserProject {
+func getUserProjectCache() *ProjectCache {
+	projectCacheMutex.RLock()
+	defer projectCacheMutex.RUnlock()
+	return userProjectCache
+}
+
+func NewUserProject(userName string, projects []string) UserProject {
 	up := UserProject{}
 	up.UserName = userName
 	up.Timestamp = time.Now().Unix()
-	up.Token = token
 	up.ProjectList = projects
 	return up
 }
 
-func deleteUserProject(up UserProject) {
-	userProjectInfo.Lock()
-	delete(userProjectInfo.ProjectInfo, up.Token)
-	userProjectInfo.Unlock()
-}
-
-func UpdateUserProject(up UserProject) {
-	userProjectInfo.Lock()
-	userProjectInfo.ProjectInfo[up.Token] = up
-	userProjectInfo.Unlock()
+// UpdateUserProject caches the projects of the user of the token, the token is only kept as its keyed hash
+func UpdateUserProject(token string, up UserProject) {
+	getUserProjectCache().Set(token, up)
 }
 
 func GetUserProjectList(token string) ([]string, bool) {
-	userProjectInfo.Lock()
-	up, ok := userProjectInfo.ProjectInfo[token]
-	userProjectInfo.Unlock()
+	up, ok := getUserProjectCache().Get(token)
 	if ok {
 		return up.ProjectList, true
 	}
 	return []string{}, false
 }
 
-func CleanExpiredProjectInfo(expiredTimeSeconds int64) {
-	InitUserProjectInfo()
-	ticker := time.NewTicker(time.Duration(time.Second * time.Duration(expiredTimeSeconds)))
+// GetProjectCacheStats returns the hits, misses and evictions of the project cache
+func GetProjectCacheStats() ProjectCacheStats {
+	return getUserProjectCache().Stats()
+}
+
+var (
+	projectCacheHitsDesc = prometheus.NewDesc("rbac_query_proxy_project_cache_hits_total",
+		"The number of the project cache reads which found the projects of the user.", nil, nil)
+	projectCacheMissesDesc = prometheus.NewDesc("rbac_query_proxy_project_cache_misses_total",
+		"The number of the project cache reads which did not find the projects of the user.", nil, nil)
+	projectCacheEvictionsDesc = prometheus.NewDesc("rbac_query_proxy_project_cache_evictions_total",
+		"The number of the users evicted from the full project cache.", nil, nil)
+	projectCacheEntriesDesc = prometheus.NewDesc("rbac_query_proxy_project_cache_entries",
+		"The number of the users in the project cache.", nil, nil)
+)
+
+// projectCacheCollector exports the counters of the project cache as metrics
+type projectCacheCollector struct{}
+
+func (projectCacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- projectCacheHitsDesc
+	ch <- projectCacheMissesDesc
+	ch <- projectCacheEvictionsDesc
+	ch <- projectCacheEntriesDesc
+}
+
+func (projectCacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := GetProjectCacheStats()
+	ch <- prometheus.MustNewConstMetric(projectCacheHitsDesc, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(projectCacheMissesDesc, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(projectCacheEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions))
+	ch <- prometheus.MustNewConstMetric(projectCacheEntriesDesc, prometheus.GaugeValue, float64(stats.Entries))
+}
+
+// RegisterProjectCacheMetrics registers the metrics of the hits, misses and evictions of the project cache
+func RegisterProjectCacheMetrics(registerer prometheus.Registerer) error {
+	return registerer.Register(projectCacheCollector{})
+}
+
+// CleanExpiredProjectInfo removes the expired projects periodically, the expired projects are not
+// returned even before they are removed
+func CleanExpiredProjectInfo(interval time.Duration) {
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		<-ticker.C
-		for _, up := range userProjectInfo.ProjectInfo {
-			if time.Now().Unix()-up.Timestamp >= expiredTimeSeconds {
-				klog.Infof("clean %v project info", up.UserName)
-				deleteUserProject(up)
-			}
-		}
+		cache := getUserProjectCache()
+		removed := cache.CleanExpired()
+		stats := cache.Stats()
+		klog.Infof("cleaned %v expired project info, project cache has %v entries, %v hits, %v misses, %v evictions",
+			removed, stats.Entries, stats.Hits, stats.Misses, stats.Evictions)
 	}
 }
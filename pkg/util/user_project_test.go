@@ -7,50 +7,23 @@ import (
 	"strconv"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestGetUserProjectList(t *testing.T) {
 	testCaseList := []struct {
-		name            string
-		token           string
-		userProjectInfo *UserProjectInfo
-		expected        bool
+		name     string
+		token    string
+		expected bool
 	}{
-		{
-			"should has user project",
-			"1",
-			&UserProjectInfo{
-				ProjectInfo: map[string]UserProject{
-					"1": UserProject{
-						UserName:    "user" + strconv.Itoa(1),
-						Timestamp:   time.Now().Unix(),
-						Token:       strconv.Itoa(1),
-						ProjectList: []string{"p" + strconv.Itoa(1)},
-					},
-				},
-			},
-			true,
-		},
-
-		{
-			"should has not user project",
-			"invalid",
-			&UserProjectInfo{
-				ProjectInfo: map[string]UserProject{
-					"1": UserProject{
-						UserName:    "user" + strconv.Itoa(1),
-						Timestamp:   time.Now().Unix(),
-						Token:       strconv.Itoa(1),
-						ProjectList: []string{"p" + strconv.Itoa(1)},
-					},
-				},
-			},
-			false,
-		},
+		{"should has user project", "1", true},
+		{"should has not user project", "invalid", false},
 	}
 
+	InitUserProjectInfo()
+	UpdateUserProject("1", NewUserProject("user"+strconv.Itoa(1), []string{"p" + strconv.Itoa(1)}))
 	for _, c := range testCaseList {
-		userProjectInfo = c.userProjectInfo
 		_, output := GetUserProjectList(c.token)
 		if output != c.expected {
 			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
@@ -59,52 +32,53 @@ func TestGetUserProjectList(t *testing.T) {
 }
 
 func TestCleanExpiredProjectInfo(t *testing.T) {
-	testCaseList := []struct {
-		name            string
-		token           string
-		userProjectInfo *UserProjectInfo
-		expected        bool
-	}{
-		{
-			"user project should expired",
-			"1",
-			&UserProjectInfo{
-				ProjectInfo: map[string]UserProject{
-					"1": UserProject{
-						UserName:    "user" + strconv.Itoa(1),
-						Timestamp:   time.Now().Unix(),
-						Token:       strconv.Itoa(1),
-						ProjectList: []string{"p" + strconv.Itoa(1)},
-					},
-				},
-			},
-			false,
-		},
+	defer SetProjectCacheConfig(defaultProjectCacheTTL, defaultProjectCacheNegativeTTL, defaultProjectCacheMaxEntries)
+	SetProjectCacheConfig(time.Second, time.Second, 0)
+	UpdateUserProject("1", NewUserProject("user1", []string{"p1"}))
 
-		{
-			"user project should not expired",
-			"2",
-			&UserProjectInfo{
-				ProjectInfo: map[string]UserProject{
-					"2": UserProject{
-						UserName:    "user" + strconv.Itoa(2),
-						Timestamp:   time.Now().Unix() + 10,
-						Token:       strconv.Itoa(2),
-						ProjectList: []string{"p" + strconv.Itoa(2)},
-					},
-				},
-			},
-			true,
-		},
+	go CleanExpiredProjectInfo(100 * time.Millisecond)
+	time.Sleep(time.Second * 2)
+	if _, output := GetUserProjectList("1"); output {
+		t.Errorf("case (user project should expired) output: (%v) is not the expected: (%v)", output, false)
+	}
+	if stats := GetProjectCacheStats(); stats.Entries != 0 {
+		t.Errorf("case (expired user project should be removed) output: (%v) is not the expected: (%v)", stats.Entries, 0)
 	}
 
-	go CleanExpiredProjectInfo(1)
-	for _, c := range testCaseList {
-		userProjectInfo = c.userProjectInfo
-		time.Sleep(time.Second * 2)
-		_, output := GetUserProjectList(c.token)
-		if output != c.expected {
-			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+	UpdateUserProject("2", NewUserProject("user2", []string{"p2"}))
+	if _, output := GetUserProjectList("2"); !output {
+		t.Errorf("case (user project should not expired) output: (%v) is not the expected: (%v)", output, true)
+	}
+}
+
+func TestProjectCacheMetrics(t *testing.T) {
+	InitUserProjectInfo()
+	defer InitUserProjectInfo()
+	UpdateUserProject("1", NewUserProject("user1", []string{"p1"}))
+	_, _ = GetUserProjectList("1")
+	_, _ = GetUserProjectList("invalid")
+
+	registry := prometheus.NewRegistry()
+	if err := RegisterProjectCacheMetrics(registry); err != nil {
+		t.Fatalf("failed to register project cache metrics: %v", err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather project cache metrics: %v", err)
+	}
+	values := map[string]float64{}
+	for _, family := range families {
+		metric := family.GetMetric()[0]
+		values[family.GetName()] = metric.GetCounter().GetValue() + metric.GetGauge().GetValue()
+	}
+	for name, expected := range map[string]float64{
+		"rbac_query_proxy_project_cache_hits_total":      1,
+		"rbac_query_proxy_project_cache_misses_total":    1,
+		"rbac_query_proxy_project_cache_evictions_total": 0,
+		"rbac_query_proxy_project_cache_entries":         1,
+	} {
+		if values[name] != expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", name, values[name], expected)
 		}
 	}
 }
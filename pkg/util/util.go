@@ -4,23 +4,31 @@
 package util
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	projectv1 "github.com/openshift/api/project/v1"
-	userv1 "github.com/openshift/api/user/v1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog"
 
@@ -32,57 +40,135 @@ import (
 const (
 	managedClusterAPIPath = "/apis/cluster.open-cluster-management.io/v1/managedclusters"
 	caPath                = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	formContentType       = "application/x-www-form-urlencoded"
+	multipartContentType  = "multipart/form-data"
+	// maxMultipartMemory is the memory used to parse the multipart bodies, like net/http
+	maxMultipartMemory = 32 << 20
+	// defaultMatchSelector is rewritten with the accessible clusters for the label
+	// names and label values requests without match[] selector
+	defaultMatchSelector = `{cluster=~".+"}`
 )
 
+// formBodyAPIPaths are the prometheus APIs which accept the query params
+// in an application/x-www-form-urlencoded or multipart/form-data POST body
+var formBodyAPIPaths = []string{
+	"/api/v1/query",
+	"/api/v1/query_range",
+	"/api/v1/query_exemplars",
+	"/api/v1/series",
+	"/api/v1/labels",
+	"/federate",
+}
+
+// ErrQueryRewrite is returned when the query cannot be rewritten with the cluster filters
+var ErrQueryRewrite = errors.New("failed to rewrite query")
+
 var allManagedClusterNames map[string]string
 var mapMutex sync.RWMutex
 
+// deletedManagedClusterNames are the clusters deleted since the proxy started, their metrics are still
+// stored upstream, so they are excluded by the negative cluster filter as well
+var deletedManagedClusterNames = map[string]bool{}
+
+// strictQueryRewrite rejects the queries which cannot be rewritten instead of
+// sending them to upstream without the cluster filters
+var strictQueryRewrite = true
+var rejectedQueryCount int64
+
+// negativeClusterMatcher allows to express the cluster filter as the negative regex of the
+// inaccessible clusters, it is only used once the clusters stored upstream are loaded
+var negativeClusterMatcher = false
+
+// upstreamClusterNames are the values of the cluster label stored upstream, the clusters deleted before the
+// proxy started are only known from them. They are nil until they are loaded
+var upstreamClusterNames map[string]bool
+
+// SetStrictQueryRewrite is used to enable or disable the strict query rewrite mode
+func SetStrictQueryRewrite(strict bool) {
+	strictQueryRewrite = strict
+}
+
+// SetNegativeClusterMatcher is used to allow or disallow the negative cluster filter
+func SetNegativeClusterMatcher(allow bool) {
+	negativeClusterMatcher = allow
+}
+
+// SetUpstreamClusterNames is used to set the values of the cluster label stored upstream, so that the negative
+// cluster filter excludes the metrics of all the clusters which are not allowed, including the deleted ones
+func SetUpstreamClusterNames(names []string) {
+	clusterNames := make(map[string]bool, len(names))
+	for _, name := range names {
+		clusterNames[name] = true
+	}
+	mapMutex.Lock()
+	upstreamClusterNames = clusterNames
+	mapMutex.Unlock()
+}
+
+// useNegativeClusterMatcher returns whether the cluster filter can be expressed as the negative regex, the
+// clusters stored upstream must be loaded, otherwise the metrics of the unknown clusters would be allowed
+func useNegativeClusterMatcher() bool {
+	if !negativeClusterMatcher {
+		return false
+	}
+	mapMutex.RLock()
+	defer mapMutex.RUnlock()
+	return upstreamClusterNames != nil
+}
+
+// GetRejectedQueryCount returns the number of queries rejected by the strict query rewrite mode
+func GetRejectedQueryCount() int64 {
+	return atomic.LoadInt64(&rejectedQueryCount)
+}
+
 func GetAllManagedClusterNames() map[string]string {
 	return allManagedClusterNames
 }
 
 func InitAllManagedClusterNames() {
 	allManagedClusterNames = map[string]string{}
+	deletedManagedClusterNames = map[string]bool{}
+	managedClusterSets = map[string]string{}
+	managedClusterLabels = map[string]labels.Set{}
 	mapMutex = sync.RWMutex{}
 }
 
-// ModifyMetricsQueryParams will modify request url params for query metrics
-func ModifyMetricsQueryParams(req *http.Request, url string) {
-	userName := req.Header.Get("X-Forwarded-User")
+// ModifyMetricsQueryParams will modify request url params and form body for query metrics,
+// an error wrapping ErrQueryRewrite is returned when the query cannot be rewritten in strict mode,
+// and rewrite.ErrEmptyResult is returned when the query does not match any accessible cluster
+func ModifyMetricsQueryParams(req *http.Request, access *UserAccess) error {
+	userName := access.UserName
 	klog.V(1).Infof("user is %v", userName)
 	klog.V(1).Infof("URL is: %s", req.URL)
 	klog.V(1).Infof("URL path is: %v", req.URL.Path)
 	klog.V(1).Infof("URL RawQuery is: %v", req.URL.RawQuery)
-	token := req.Header.Get("X-Forwarded-Access-Token")
-	if token == "" {
-		klog.Errorf("failed to get token from http header")
+	if access.IsUnrestricted() {
+		klog.Infof("user <%v> have access to all clusters", userName)
+		return nil
 	}
 
-	projectList, ok := GetUserProjectList(token)
-	klog.V(1).Infof("projectList from local mem cache = %v, ok = %v", projectList, ok)
-	if !ok {
-		projectList = FetchUserProjectList(token, url)
-		up := NewUserProject(userName, token, projectList)
-		UpdateUserProject(up)
-		klog.V(1).Infof("projectList from api server = %v", projectList)
+	klog.Infof("user <%v> have access to these clusters: %v", userName, access.Clusters)
+	if access.Namespaces != nil {
+		klog.Infof("user <%v> have access to these namespaces: %v", userName, access.Namespaces)
 	}
-
-	klog.V(1).Infof("cluster list: %v", allManagedClusterNames)
-	klog.V(1).Infof("user <%s> project list: %v", userName, projectList)
-	if canAccessAllClusters(projectList) {
-		klog.Infof("user <%v> have access to all clusters", userName)
-		return
+	if err := modifyFormBody(req, access); err != nil {
+		rejectQuery(userName, err)
+		return err
 	}
 
-	clusterList := getUserClusterList(projectList)
-	klog.Infof("user <%v> have access to these clusters: %v", userName, clusterList)
 	queryValues := req.URL.Query()
+	if isLabelsAPIPath(req.URL.Path) && !isFormBodyRequest(req) {
+		addDefaultMatchSelector(queryValues)
+	}
 	if len(queryValues) == 0 {
-		return
+		return nil
 	}
 
-	queryValues = rewriteQuery(queryValues, clusterList, "query")
-	queryValues = rewriteQuery(queryValues, clusterList, "match[]")
+	queryValues, err := rewriteQueryValues(queryValues, access)
+	if err != nil {
+		rejectQuery(userName, err)
+		return err
+	}
 	req.URL.RawQuery = queryValues.Encode()
 
 	queryValues = req.URL.Query()
@@ -90,7 +176,16 @@ func ModifyMetricsQueryParams(req *http.Request, url string) {
 	klog.V(1).Infof("URL is: %s", req.URL)
 	klog.V(1).Infof("URL path is: %v", req.URL.Path)
 	klog.V(1).Infof("URL RawQuery is: %v", req.URL.RawQuery)
-	return
+	return nil
+}
+
+func rejectQuery(userName string, err error) {
+	if errors.Is(err, rewrite.ErrEmptyResult) {
+		klog.Infof("query from user <%v> does not match any accessible cluster", userName)
+		return
+	}
+	count := atomic.AddInt64(&rejectedQueryCount, 1)
+	klog.Warningf("rejected query from user <%v>, %v queries rejected in total: %v", userName, count, err)
 }
 
 // WatchManagedCluster will watch and save managedcluster when create/update/delete managedcluster
@@ -108,6 +203,9 @@ func WatchManagedCluster(clusterClient clusterclientset.Interface) {
 				klog.Infof("added a managedcluster: %s \n", obj.(*clusterv1.ManagedCluster).Name)
 				mapMutex.Lock()
 				allManagedClusterNames[clusterName] = clusterName
+				delete(deletedManagedClusterNames, clusterName)
+				updateManagedClusterSet(obj.(*clusterv1.ManagedCluster))
+				updateManagedClusterLabels(obj.(*clusterv1.ManagedCluster))
 				mapMutex.Unlock()
 			},
 
@@ -116,6 +214,9 @@ func WatchManagedCluster(clusterClient clusterclientset.Interface) {
 				klog.Infof("deleted a managedcluster: %s \n", obj.(*clusterv1.ManagedCluster).Name)
 				mapMutex.Lock()
 				delete(allManagedClusterNames, clusterName)
+				deletedManagedClusterNames[clusterName] = true
+				delete(managedClusterSets, clusterName)
+				delete(managedClusterLabels, clusterName)
 				mapMutex.Unlock()
 			},
 
@@ -124,6 +225,9 @@ func WatchManagedCluster(clusterClient clusterclientset.Interface) {
 				klog.Infof("changed a managedcluster: %s \n", newObj.(*clusterv1.ManagedCluster).Name)
 				mapMutex.Lock()
 				allManagedClusterNames[clusterName] = clusterName
+				delete(deletedManagedClusterNames, clusterName)
+				updateManagedClusterSet(newObj.(*clusterv1.ManagedCluster))
+				updateManagedClusterLabels(newObj.(*clusterv1.ManagedCluster))
 				mapMutex.Unlock()
 			},
 		},
@@ -140,11 +244,21 @@ func WatchManagedCluster(clusterClient clusterclientset.Interface) {
 }
 
 func sendHTTPRequest(url string, verb string, token string) (*http.Response, error) {
+	return sendHTTPRequestWithHeader(url, verb, token, nil)
+}
+
+// sendHTTPRequestWithHeader sends the http request with the additional header, e.g. the impersonation headers
+func sendHTTPRequestWithHeader(url string, verb string, token string, header http.Header) (*http.Response, error) {
 	req, err := http.NewRequest(verb, url, nil)
 	if err != nil {
 		klog.Errorf("failed to new http request: %v", err)
 		return nil, err
 	}
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
 
 	if len(token) == 0 {
 		transport := &http.Transport{}
@@ -179,7 +293,19 @@ func sendHTTPRequest(url string, verb string, token string) (*http.Response, err
 }
 
 func FetchUserProjectList(token string, url string) []string {
-	resp, err := sendHTTPRequest(url, "GET", token)
+	return fetchUserProjectList(token, nil, url)
+}
+
+// fetchUserProjectList returns the projects of the user of the token, or of the user impersonated with the token
+func fetchUserProjectList(token string, imp *Impersonation, url string) []string {
+	header := http.Header{}
+	if imp != nil {
+		header.Set(ImpersonateUserHeader, imp.UserName)
+		for _, group := range imp.Groups {
+			header.Add(ImpersonateGroupHeader, group)
+		}
+	}
+	resp, err := sendHTTPRequestWithHeader(url, "GET", token, header)
 	if err != nil {
 		klog.Errorf("failed to send http request: %v", err)
 		/*
@@ -208,18 +334,9 @@ func FetchUserProjectList(token string, url string) []string {
 }
 
 func GetUserName(token string, url string) string {
-	resp, err := sendHTTPRequest(url, "GET", token)
-	if err != nil {
-		klog.Errorf("failed to send http request: %v", err)
-		writeError(fmt.Sprintf("failed to send http request: %v", err))
-		return ""
-	}
-	defer resp.Body.Close()
-
-	user := userv1.User{}
-	err = json.NewDecoder(resp.Body).Decode(&user)
+	user, err := NewOpenShiftAuthenticator(url).Authenticate(token)
 	if err != nil {
-		klog.Errorf("failed to decode response json body: %v", err)
+		klog.Errorf("failed to get user: %v", err)
 		return ""
 	}
 
@@ -239,22 +356,57 @@ func Contains(list []string, s string) bool {
 // canAccessAllClusters check user have permission to access all clusters
 func canAccessAllClusters(projectList []string) bool {
 	mapMutex.RLock()
+	defer mapMutex.RUnlock()
 	if len(allManagedClusterNames) == 0 && len(projectList) == 0 {
-		mapMutex.RUnlock()
 		return false
 	}
 
+	projectSet := make(map[string]bool, len(projectList))
+	for _, projectName := range projectList {
+		projectSet[projectName] = true
+	}
 	for name := range allManagedClusterNames {
-		if !Contains(projectList, name) {
-			mapMutex.RUnlock()
+		if !projectSet[name] {
 			return false
 		}
 	}
 
-	mapMutex.RUnlock()
 	return true
 }
 
+// getAllManagedClusterList returns the sorted names of all managed clusters
+func getAllManagedClusterList() []string {
+	mapMutex.RLock()
+	clusterList := make([]string, 0, len(allManagedClusterNames))
+	for name := range allManagedClusterNames {
+		clusterList = append(clusterList, name)
+	}
+	mapMutex.RUnlock()
+
+	sort.Strings(clusterList)
+	return clusterList
+}
+
+// getKnownClusterList returns the managed clusters, the clusters deleted since the proxy started and
+// the clusters stored upstream
+func getKnownClusterList() []string {
+	otherClusters := []string{}
+	mapMutex.RLock()
+	for name := range deletedManagedClusterNames {
+		otherClusters = append(otherClusters, name)
+	}
+	for name := range upstreamClusterNames {
+		if name != "" {
+			otherClusters = append(otherClusters, name)
+		}
+	}
+	mapMutex.RUnlock()
+	clusterList := mergeLists(getAllManagedClusterList(), otherClusters)
+
+	sort.Strings(clusterList)
+	return clusterList
+}
+
 func getUserClusterList(projectList []string) []string {
 	clusterList := []string{}
 	if len(projectList) == 0 {
@@ -273,20 +425,209 @@ func getUserClusterList(projectList []string) []string {
 	return clusterList
 }
 
-func rewriteQuery(queryValues url.Values, clusterList []string, key string) url.Values {
-	originalQuery := queryValues.Get(key)
-	if len(originalQuery) == 0 {
-		return queryValues
+// mergeLists appends the values which are not in the list yet
+func mergeLists(list []string, values []string) []string {
+	listed := make(map[string]bool, len(list))
+	for _, value := range list {
+		listed[value] = true
+	}
+	for _, value := range values {
+		if !listed[value] {
+			listed[value] = true
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+func rewriteQueryValues(queryValues url.Values, access *UserAccess) (url.Values, error) {
+	queryValues, err := rewriteQuery(queryValues, access, "query")
+	if err != nil {
+		return queryValues, err
+	}
+	return rewriteQuery(queryValues, access, "match[]")
+}
+
+// rewriteQuery rewrites each value of the key on its own, e.g. the match[] selectors of the federate,
+// series and labels APIs. The values which do not match any accessible cluster are dropped, and
+// ErrEmptyResult is returned with the values unchanged when none of them matches. The match[]
+// selectors of the clusters with different namespace scopes are split into several selectors
+func rewriteQuery(queryValues url.Values, access *UserAccess, key string) (url.Values, error) {
+	originalQueries := queryValues[key]
+	if len(originalQueries) == 0 {
+		return queryValues, nil
+	}
+
+	modifiedQueries := make([]string, 0, len(originalQueries))
+	// emptyErr is the error of the last dropped value, so that the type of the empty result is kept
+	emptyErr := rewrite.ErrEmptyResult
+	for _, originalQuery := range originalQueries {
+		if len(originalQuery) == 0 {
+			modifiedQueries = append(modifiedQueries, originalQuery)
+			continue
+		}
+
+		inject := func(query string) ([]string, error) {
+			modifiedQuery, err := access.injectLabels(query)
+			return []string{modifiedQuery}, err
+		}
+		if key == "match[]" {
+			inject = access.injectSelectorLabels
+		}
+		modifiedQuery, err := rewriteQueryStrings(originalQuery, inject)
+		if errors.Is(err, rewrite.ErrEmptyResult) {
+			klog.V(1).Infof("drop %v %q which does not match any accessible cluster", key, originalQuery)
+			emptyErr = err
+			continue
+		}
+		if err != nil {
+			return queryValues, err
+		}
+		modifiedQueries = append(modifiedQueries, modifiedQuery...)
+	}
+	if len(modifiedQueries) == 0 {
+		return queryValues, emptyErr
+	}
+
+	queryValues[key] = modifiedQueries
+	return queryValues, nil
+}
+
+// rewriteQueryString rewrites the query with the filters of the user access, the query
+// is returned as is when it cannot be rewritten and the strict mode is disabled
+func rewriteQueryString(query string, access *UserAccess) (string, error) {
+	modifiedQueries, err := rewriteQueryStrings(query, func(query string) ([]string, error) {
+		modifiedQuery, err := access.injectLabels(query)
+		return []string{modifiedQuery}, err
+	})
+	if err != nil {
+		return query, err
+	}
+	return modifiedQueries[0], nil
+}
+
+// rewriteQueryStrings rewrites the query with the inject function, which may return several
+// queries, the query is returned as is when it cannot be rewritten and the strict mode is disabled
+func rewriteQueryStrings(query string, inject func(string) ([]string, error)) ([]string, error) {
+	modifiedQueries, err := inject(query)
+	if errors.Is(err, rewrite.ErrEmptyResult) {
+		return []string{query}, err
+	}
+	if err != nil {
+		// the query must not be sent without the filters when it is denied by the namespace scope
+		if strictQueryRewrite || errors.Is(err, rewrite.ErrAmbiguousScope) {
+			return []string{query}, fmt.Errorf("%w %q: %v", ErrQueryRewrite, query, err)
+		}
+		klog.Warningf("send query %q without cluster filters: %v", query, err)
+		return []string{query}, nil
+	}
+	return modifiedQueries, nil
+}
+
+// modifyFormBody will modify the query params sent in a form-encoded or multipart POST body,
+// the body is re-encoded as a form-encoded body and the content length is updated accordingly
+func modifyFormBody(req *http.Request, access *UserAccess) error {
+	if !isFormBodyRequest(req) {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read request body: %v", err)
 	}
 
-	modifiedQuery, err := rewrite.InjectLabels(originalQuery, "cluster", clusterList)
+	formValues, err := parseFormBody(req, body)
 	if err != nil {
-		return queryValues
+		return fmt.Errorf("%w: %v", ErrQueryRewrite, err)
 	}
 
-	queryValues.Del(key)
-	queryValues.Add(key, modifiedQuery)
-	return queryValues
+	// the match[] selector in the url query is also used by upstream
+	if isLabelsAPIPath(req.URL.Path) && len(req.URL.Query()["match[]"]) == 0 {
+		addDefaultMatchSelector(formValues)
+	}
+	formValues, err = rewriteQueryValues(formValues, access)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", formContentType)
+	setRequestBody(req, formValues.Encode())
+	klog.V(1).Infof("modified request body is: %v", formValues.Encode())
+	return nil
+}
+
+// parseFormBody returns the values of the form-encoded or multipart body, the files of the multipart
+// body are dropped since they are not used by the prometheus APIs
+func parseFormBody(req *http.Request, body []byte) (url.Values, error) {
+	mediaType, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != multipartContentType {
+		// values which failed to be parsed are dropped, so that they cannot reach upstream unfiltered
+		formValues, err := url.ParseQuery(string(body))
+		if err != nil {
+			klog.Errorf("failed to parse request body: %v", err)
+		}
+		return formValues, nil
+	}
+
+	form, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(maxMultipartMemory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse multipart request body: %v", err)
+	}
+	defer func() { _ = form.RemoveAll() }()
+	return url.Values(form.Value), nil
+}
+
+func isFormBodyRequest(req *http.Request) bool {
+	if req.Method != http.MethodPost || req.Body == nil || req.Body == http.NoBody {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || (mediaType != formContentType && mediaType != multipartContentType) {
+		return false
+	}
+
+	if isLabelValuesAPIPath(req.URL.Path) {
+		return true
+	}
+	for _, apiPath := range formBodyAPIPaths {
+		if strings.HasSuffix(req.URL.Path, apiPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLabelsAPIPath checks whether the path is the label names or label values api
+func isLabelsAPIPath(path string) bool {
+	return strings.HasSuffix(path, "/api/v1/labels") || isLabelValuesAPIPath(path)
+}
+
+// addDefaultMatchSelector adds the match[] selector when there is none, so that the label
+// names and label values apis only return the labels of the accessible clusters
+func addDefaultMatchSelector(values url.Values) {
+	if len(values["match[]"]) == 0 {
+		values.Set("match[]", defaultMatchSelector)
+	}
+}
+
+// isLabelValuesAPIPath checks whether the path is /api/v1/label/<label_name>/values
+func isLabelValuesAPIPath(path string) bool {
+	idx := strings.LastIndex(path, "/api/v1/label/")
+	if idx < 0 {
+		return false
+	}
+	labelPath := strings.TrimPrefix(path[idx:], "/api/v1/label/")
+	return strings.HasSuffix(labelPath, "/values") && strings.Count(labelPath, "/") == 1
+}
+
+func setRequestBody(req *http.Request, body string) {
+	req.Body = ioutil.NopCloser(strings.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
 }
 
 func writeError(msg string) {
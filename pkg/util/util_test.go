@@ -4,12 +4,20 @@
 package util
 
 import (
+	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/stolostron/rbac-query-proxy/pkg/rewrite"
 )
 
 func newTTPRequest() *http.Request {
@@ -27,7 +35,7 @@ func createFakeServerWithInvalidJSON(port string, t *testing.T) {
 	)
 	err := http.ListenAndServe(":"+port, server)
 	if err != nil {
-		t.Fatal("fail to create internal server at " + port)
+		t.Error("fail to create internal server at " + port)
 	}
 }
 
@@ -93,7 +101,7 @@ func createFakeServer(port string, t *testing.T) {
 	)
 	err := http.ListenAndServe(":"+port, server)
 	if err != nil {
-		t.Fatal("fail to create internal server at " + port)
+		t.Error("fail to create internal server at " + port)
 	}
 }
 func TestModifyMetricsQueryParams(t *testing.T) {
@@ -132,13 +140,198 @@ func TestGetAllManagedClusterNames(t *testing.T) {
 	for _, c := range testCaseList {
 		allManagedClusterNames = c.clusters
 		req := newTTPRequest()
-		ModifyMetricsQueryParams(req, "http://127.0.0.1:3002/")
+		ModifyMetricsQueryParams(req, GetUserAccess(req, "http://127.0.0.1:3002/"))
 		if req.URL.RawQuery != c.expected {
 			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, req.URL.RawQuery, c.expected)
 		}
 	}
 }
 
+func TestModifyMetricsQueryParamsWithFormBody(t *testing.T) {
+	testCaseList := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		expected    string
+	}{
+		{
+			"should rewrite query in form body",
+			http.MethodPost,
+			"/api/v1/query",
+			"application/x-www-form-urlencoded",
+			"query=foo",
+			`query=foo%7Bcluster%3D%22c0%22%7D`,
+		},
+		{
+			"should rewrite match in form body",
+			http.MethodPost,
+			"/api/metrics/v1/default/api/v1/series",
+			"application/x-www-form-urlencoded; charset=UTF-8",
+			"match%5B%5D=foo&start=1",
+			`match%5B%5D=foo%7Bcluster%3D%22c0%22%7D&start=1`,
+		},
+		{
+			"should rewrite match in label values form body",
+			http.MethodPost,
+			"/api/v1/label/cluster/values",
+			"application/x-www-form-urlencoded",
+			"match%5B%5D=foo",
+			`match%5B%5D=foo%7Bcluster%3D%22c0%22%7D`,
+		},
+		{
+			"should rewrite query in multipart body",
+			http.MethodPost,
+			"/api/v1/query",
+			"multipart/form-data; boundary=b",
+			"--b\r\nContent-Disposition: form-data; name=\"query\"\r\n\r\nfoo\r\n--b--\r\n",
+			`query=foo%7Bcluster%3D%22c0%22%7D`,
+		},
+		{
+			"should not rewrite non form body",
+			http.MethodPost,
+			"/api/v1/query",
+			"application/json",
+			"query=foo",
+			"query=foo",
+		},
+		{
+			"should not rewrite body for unknown api",
+			http.MethodPost,
+			"/api/v1/unknown",
+			"application/x-www-form-urlencoded",
+			"query=foo",
+			"query=foo",
+		},
+	}
+	go createFakeServer("6002", t)
+	time.Sleep(time.Second)
+	allManagedClusterNames = map[string]string{"c0": "c0", "c2": "c2"}
+	for _, c := range testCaseList {
+		req, _ := http.NewRequest(c.method, "http://127.0.0.1:3002"+c.path, strings.NewReader(c.body))
+		req.Header.Set("X-Forwarded-User", "test")
+		req.Header.Set("Content-Type", c.contentType)
+		ModifyMetricsQueryParams(req, GetUserAccess(req, "http://127.0.0.1:6002/"))
+		body, _ := ioutil.ReadAll(req.Body)
+		if string(body) != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, string(body), c.expected)
+		}
+		if req.ContentLength != int64(len(c.expected)) {
+			t.Errorf("case (%v) content length: (%v) is not the expected: (%v)", c.name, req.ContentLength, len(c.expected))
+		}
+		// the rewritten bodies are form-encoded
+		if string(body) != c.body && req.Header.Get("Content-Type") != formContentType {
+			t.Errorf("case (%v) content type: (%v) is not the expected: (%v)", c.name, req.Header.Get("Content-Type"), formContentType)
+		}
+	}
+}
+
+func TestModifyMetricsQueryParamsWithInvalidFormBody(t *testing.T) {
+	testCaseList := []struct {
+		name        string
+		contentType string
+		body        io.Reader
+	}{
+		{"failed to read body", "application/x-www-form-urlencoded", iotest.ErrReader(errors.New("connection reset"))},
+		{"multipart body without boundary", "multipart/form-data", strings.NewReader("query=foo")},
+		{"invalid multipart body", "multipart/form-data; boundary=b", strings.NewReader("--b\r\nquery=foo")},
+	}
+
+	access := NewUserAccess("test", false, []string{"c0"}, nil)
+	for _, c := range testCaseList {
+		req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1:3002/api/v1/query", c.body)
+		req.Header.Set("Content-Type", c.contentType)
+		if err := ModifyMetricsQueryParams(req, access); err == nil {
+			t.Errorf("case (%v) should return error", c.name)
+		}
+	}
+}
+
+func TestModifyMetricsQueryParamsForLabelsAPI(t *testing.T) {
+	testCaseList := []struct {
+		name     string
+		rawURL   string
+		expected string
+	}{
+		{
+			"should add match selector for label values",
+			"http://127.0.0.1:3002/api/v1/label/cluster/values",
+			`match%5B%5D=%7Bcluster%3D%22c0%22%7D`,
+		},
+		{
+			"should add match selector for label names",
+			"http://127.0.0.1:3002/api/v1/labels?start=1",
+			`match%5B%5D=%7Bcluster%3D%22c0%22%7D&start=1`,
+		},
+		{
+			"should rewrite the existing match selector",
+			"http://127.0.0.1:3002/api/v1/label/namespace/values?match%5B%5D=foo",
+			`match%5B%5D=foo%7Bcluster%3D%22c0%22%7D`,
+		},
+		{
+			"should rewrite each match selector",
+			"http://127.0.0.1:3002/api/v1/series?match%5B%5D=foo&match%5B%5D=bar",
+			`match%5B%5D=foo%7Bcluster%3D%22c0%22%7D&match%5B%5D=bar%7Bcluster%3D%22c0%22%7D`,
+		},
+		{
+			"should drop the match selector of inaccessible cluster",
+			"http://127.0.0.1:3002/federate?match%5B%5D=foo&match%5B%5D=bar%7Bcluster%3D%22c2%22%7D",
+			`match%5B%5D=foo%7Bcluster%3D%22c0%22%7D`,
+		},
+		{
+			"should not add match selector for other api",
+			"http://127.0.0.1:3002/api/v1/query?query=foo",
+			`query=foo%7Bcluster%3D%22c0%22%7D`,
+		},
+	}
+
+	allManagedClusterNames = map[string]string{"c0": "c0", "c2": "c2"}
+	for _, c := range testCaseList {
+		req, _ := http.NewRequest("GET", c.rawURL, nil)
+		req.Header.Set("X-Forwarded-User", "test")
+		err := ModifyMetricsQueryParams(req, GetUserAccess(req, "http://127.0.0.1:3002/"))
+		if err != nil {
+			t.Errorf("case (%v) failed to modify query params: %v", c.name, err)
+		}
+		if req.URL.RawQuery != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, req.URL.RawQuery, c.expected)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1:3002/api/v1/labels", strings.NewReader("start=1"))
+	req.Header.Set("X-Forwarded-User", "test")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := ModifyMetricsQueryParams(req, GetUserAccess(req, "http://127.0.0.1:3002/")); err != nil {
+		t.Errorf("case (form body) failed to modify query params: %v", err)
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	expected := `match%5B%5D=%7Bcluster%3D%22c0%22%7D&start=1`
+	if string(body) != expected || req.URL.RawQuery != "" {
+		t.Errorf("case (form body) output: (%v, %v) is not the expected: (%v, )", string(body), req.URL.RawQuery, expected)
+	}
+}
+
+func TestIsLabelValuesAPIPath(t *testing.T) {
+	testCaseList := []struct {
+		name     string
+		path     string
+		expected bool
+	}{
+		{"label values api", "/api/v1/label/cluster/values", true},
+		{"label values api with base path", "/api/metrics/v1/default/api/v1/label/__name__/values", true},
+		{"labels api", "/api/v1/labels", false},
+		{"invalid label values api", "/api/v1/label/a/b/values", false},
+	}
+
+	for _, c := range testCaseList {
+		output := isLabelValuesAPIPath(c.path)
+		if output != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
+		}
+	}
+}
+
 func TestContains(t *testing.T) {
 	testCaseList := []struct {
 		name     string
@@ -183,24 +376,121 @@ func TestRewriteQuery(t *testing.T) {
 			"key",
 			"value{cluster=~\"c1|c2\"}",
 		},
-
-		{
-			"empty cluster list",
-			map[string][]string{"key": []string{"value"}},
-			[]string{},
-			"key",
-			"value{cluster=~\"\"}",
-		},
 	}
 
 	for _, c := range testCaseList {
-		output := rewriteQuery(c.urlValue, c.clusterList, c.key)
+		output, err := rewriteQuery(c.urlValue, NewUserAccess("test", false, c.clusterList, nil), c.key)
+		if err != nil {
+			t.Errorf("case (%v) failed to rewrite query: %v", c.name, err)
+		}
 		if output.Get(c.key) != c.expected {
 			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output, c.expected)
 		}
 	}
 }
 
+func TestRewriteQueryWithNamespaceScope(t *testing.T) {
+	testCaseList := []struct {
+		name     string
+		query    string
+		expected string
+		hasError bool
+	}{
+		{"should rewrite with namespace", "foo", `(foo{cluster="c1",namespace=~"ns1|ns2"} or foo{cluster="c2",namespace="ns3"})`, false},
+		{"should reject ambiguous range vector", "foo[5m]", "", true},
+		{"should rewrite with cluster", `foo{cluster="c1"}`, `foo{cluster="c1",namespace=~"ns1|ns2"}`, false},
+		{"should rewrite with namespace filter", `foo{namespace="ns3"}`, `foo{cluster="c2",namespace="ns3"}`, false},
+	}
+
+	access := NewUserAccess("test", false, []string{"c1", "c2"},
+		map[string][]string{"c1": {"ns1", "ns2"}, "c2": {"ns3"}})
+	defer SetStrictQueryRewrite(true)
+	SetStrictQueryRewrite(false)
+	for _, c := range testCaseList {
+		output, err := rewriteQuery(map[string][]string{"query": []string{c.query}}, access, "query")
+		if (err != nil) != c.hasError {
+			t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, c.hasError)
+		}
+		if err == nil && output.Get("query") != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, output.Get("query"), c.expected)
+		}
+	}
+
+	// the match[] selector is split into a selector for each namespace scope
+	output, err := rewriteQuery(map[string][]string{"match[]": []string{"foo"}}, access, "match[]")
+	expected := []string{`foo{cluster="c1",namespace=~"ns1|ns2"}`, `foo{cluster="c2",namespace="ns3"}`}
+	if err != nil || !reflect.DeepEqual(output["match[]"], expected) {
+		t.Errorf("case (split match selector) output: (%v, %v) is not the expected: (%v)", output["match[]"], err, expected)
+	}
+}
+
+func TestRewriteQueryWithEmptyClusterList(t *testing.T) {
+	rejected := GetRejectedQueryCount()
+	output, err := rewriteQuery(map[string][]string{"key": []string{"value"}}, NewUserAccess("test", false, []string{}, nil), "key")
+	if !errors.Is(err, rewrite.ErrEmptyResult) {
+		t.Errorf("error: (%v) is not the expected: (%v)", err, rewrite.ErrEmptyResult)
+	}
+	if output.Get("key") != "value" {
+		t.Errorf("output: (%v) is not the expected: (value)", output.Get("key"))
+	}
+	if GetRejectedQueryCount() != rejected {
+		t.Errorf("rejected count: (%v) is not the expected: (%v)", GetRejectedQueryCount(), rejected)
+	}
+}
+
+func TestRewriteQueryWithEmptyResultType(t *testing.T) {
+	access := NewUserAccess("test", false, []string{"c1"}, nil)
+	testCaseList := []struct {
+		name     string
+		query    string
+		expected parser.ValueType
+	}{
+		{"instant vector", `up{cluster="c2"}`, parser.ValueTypeVector},
+		{"range vector", `up{cluster="c2"}[5m]`, parser.ValueTypeMatrix},
+	}
+
+	for _, c := range testCaseList {
+		_, err := rewriteQuery(map[string][]string{"query": []string{c.query}}, access, "query")
+		var emptyResultErr *rewrite.EmptyResultError
+		if !errors.As(err, &emptyResultErr) || emptyResultErr.ValueType != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, err, c.expected)
+		}
+	}
+}
+
+func TestRewriteQueryWithInvalidQuery(t *testing.T) {
+	testCaseList := []struct {
+		name     string
+		strict   bool
+		expected string
+		hasError bool
+	}{
+		{"should reject in strict mode", true, "", true},
+		{"should not reject in non-strict mode", false, "foo{", false},
+	}
+
+	defer SetStrictQueryRewrite(true)
+	allManagedClusterNames = map[string]string{"c0": "c0", "c2": "c2"}
+	for _, c := range testCaseList {
+		SetStrictQueryRewrite(c.strict)
+		rejected := GetRejectedQueryCount()
+		req, _ := http.NewRequest("GET", "http://127.0.0.1:3002/api/v1/query?query=foo%7B", nil)
+		err := ModifyMetricsQueryParams(req, GetUserAccess(req, "http://127.0.0.1:3002/"))
+		if (err != nil) != c.hasError {
+			t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, c.hasError)
+		}
+		if err != nil && !errors.Is(err, ErrQueryRewrite) {
+			t.Errorf("case (%v) error: (%v) is not the expected: (%v)", c.name, err, ErrQueryRewrite)
+		}
+		if err == nil && req.URL.Query().Get("query") != c.expected {
+			t.Errorf("case (%v) output: (%v) is not the expected: (%v)", c.name, req.URL.Query().Get("query"), c.expected)
+		}
+		if c.hasError && GetRejectedQueryCount() != rejected+1 {
+			t.Errorf("case (%v) rejected count: (%v) is not the expected: (%v)", c.name, GetRejectedQueryCount(), rejected+1)
+		}
+	}
+}
+
 func TestCanAccessAllClusters(t *testing.T) {
 	testCaseList := []struct {
 		name        string